@@ -1,11 +1,14 @@
 package cmd
 
 import (
+	"os"
+
 	"github.com/jenkins-x-apps/jx-app-sonar-scanner/internal/logging"
 	"github.com/jenkins-x-apps/jx-app-sonar-scanner/internal/pipeline"
 	sonarutil "github.com/jenkins-x-apps/jx-app-sonar-scanner/internal/util"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
@@ -14,7 +17,14 @@ const (
 	apiKeyOptionName        = "apiKey"
 	scanonpreviewOptionName = "scanonpreview"
 	scanonreleaseOptionName = "scanonrelease"
+	scanonfeatureOptionName = "scanonfeature"
 	contextOptionName       = "pipeline-context"
+	dryRunOptionName        = "dry-run"
+	outputOptionName        = "output"
+	allContextsOptionName   = "all-contexts"
+	orgDefaultsOptionName   = "org-defaults"
+	policyOptionName        = "policy"
+	buildPacksOptionName    = "buildpacks"
 )
 
 var (
@@ -26,34 +36,58 @@ var (
 		Short: "configures pom.xml and effective pipeline config",
 		Run:   configure,
 	}
-	sqServer      string
-	apiKey        string
-	scanonpreview bool
-	scanonrelease bool
-	context       string
+	dryRun      bool
+	output      string
+	allContexts bool
+	orgDefaults string
+	policy      string
+	buildPacks  string
 )
 
 func init() {
-	configureCmd.Flags().StringVar(&sqServer, sqServerOptionName, "", "The URL of your Sonarqube server instance including protocol and port.")
-	_ = viper.BindPFlag(sqServerOptionName, configureCmd.Flags().Lookup(sqServerOptionName))
-	viper.SetDefault(sqServerOptionName, "http://jx-sonarqube.sonarqube.svc.cluster.local:9000")
+	// These options are layered by pipeline.LoadOptions rather than bound to viper
+	defaults := pipeline.DefaultOptions()
+	configureCmd.Flags().String(sqServerOptionName, defaults.SQServer, "The URL of your Sonarqube server instance including protocol and port.")
+	configureCmd.Flags().String(apiKeyOptionName, defaults.APIKey, "The Sonarqube user token, if required by your server instance.")
+	configureCmd.Flags().BoolP(scanonpreviewOptionName, "p", defaults.ScanOnPreview, "Run Sonarqube scans against all preview builds.")
+	configureCmd.Flags().BoolP(scanonreleaseOptionName, "r", defaults.ScanOnRelease, "Run Sonarqube scans against all release builds.")
+	configureCmd.Flags().BoolP(scanonfeatureOptionName, "f", defaults.ScanOnFeature, "Run Sonarqube scans against all feature branch builds.")
+	configureCmd.Flags().String(contextOptionName, defaults.Context, "The build context")
+
+	configureCmd.Flags().BoolVar(&dryRun, dryRunOptionName, false, "Print a unified diff of the changes to the effective pipeline instead of writing them.")
+	_ = viper.BindPFlag(dryRunOptionName, configureCmd.Flags().Lookup(dryRunOptionName))
+
+	configureCmd.Flags().StringVarP(&output, outputOptionName, "o", pipeline.OutputText, "The output format, either text or json. json prints the insertion decisions.")
+	_ = viper.BindPFlag(outputOptionName, configureCmd.Flags().Lookup(outputOptionName))
+	viper.SetDefault(outputOptionName, pipeline.OutputText)
 
-	configureCmd.Flags().StringVar(&apiKey, apiKeyOptionName, "", "The Sonarqube user token, if required by your server instance.")
-	_ = viper.BindPFlag(apiKeyOptionName, configureCmd.Flags().Lookup(apiKeyOptionName))
+	configureCmd.Flags().BoolVar(&allContexts, allContextsOptionName, false, "Patch the effective pipeline of every build context found in the source directory.")
+	_ = viper.BindPFlag(allContextsOptionName, configureCmd.Flags().Lookup(allContextsOptionName))
 
-	configureCmd.Flags().BoolVarP(&scanonpreview, scanonpreviewOptionName, "p", true, "Run Sonarqube scans against all preview builds.")
-	_ = viper.BindPFlag(scanonpreviewOptionName, configureCmd.Flags().Lookup(scanonpreviewOptionName))
+	configureCmd.Flags().StringVar(&orgDefaults, orgDefaultsOptionName, pipeline.DefaultOrgDefaultsFile, "The file holding the org-wide defaults of .jx-app-sonar-scanner.yaml, typically a mounted ConfigMap.")
+	_ = viper.BindPFlag(orgDefaultsOptionName, configureCmd.Flags().Lookup(orgDefaultsOptionName))
+	viper.SetDefault(orgDefaultsOptionName, pipeline.DefaultOrgDefaultsFile)
 
-	configureCmd.Flags().BoolVarP(&scanonrelease, scanonreleaseOptionName, "r", true, "Run Sonarqube scans against all release builds.")
-	_ = viper.BindPFlag(scanonreleaseOptionName, configureCmd.Flags().Lookup(scanonreleaseOptionName))
+	configureCmd.Flags().StringVar(&policy, policyOptionName, pipeline.DefaultPolicyFile, "The file holding the org policy restricting which settings repositories may override, typically a mounted ConfigMap.")
+	_ = viper.BindPFlag(policyOptionName, configureCmd.Flags().Lookup(policyOptionName))
+	viper.SetDefault(policyOptionName, pipeline.DefaultPolicyFile)
 
-	configureCmd.Flags().StringVar(&context, contextOptionName, "", "The build context")
-	_ = viper.BindPFlag(contextOptionName, configureCmd.Flags().Lookup(contextOptionName))
-	viper.SetDefault(contextOptionName, "")
+	configureCmd.Flags().StringVar(&buildPacks, buildPacksOptionName, pipeline.DefaultBuildPacksFile, "The file holding build packs to recognise on top of the built-in ones, typically a mounted ConfigMap.")
+	_ = viper.BindPFlag(buildPacksOptionName, configureCmd.Flags().Lookup(buildPacksOptionName))
+	viper.SetDefault(buildPacksOptionName, pipeline.DefaultBuildPacksFile)
 }
 
 func configure(cmd *cobra.Command, args []string) {
-	multiError := verify()
+	flags := map[string]string{}
+	cmd.Flags().Visit(func(flag *pflag.Flag) {
+		flags[flag.Name] = flag.Value.String()
+	})
+	options, provenance, err := pipeline.LoadOptions(flags, os.Getenv)
+	if err != nil {
+		configureCmdLogger.Fatal(err)
+	}
+
+	multiError := verify(options)
 	if !multiError.Empty() {
 		for _, err := range multiError.Errors {
 			configureCmdLogger.Error(err.Error())
@@ -62,19 +96,35 @@ func configure(cmd *cobra.Command, args []string) {
 		configureCmdLogger.Fatal("not all required parameters for this command execution specified")
 	}
 
-	if sonarutil.AppropriateToScan() {
-		pipelineExtender := pipeline.NewPatcher(sourceDir, viper.GetString(contextOptionName), sqServer, apiKey, scanonpreview, scanonrelease)
-		err := pipelineExtender.ConfigurePipeline()
+	if viper.GetBool(dryRunOptionName) || viper.GetString(outputOptionName) == pipeline.OutputJSON {
+		// Keep stdout for the diff or the decisions
+		log.SetOutput(os.Stderr)
+	}
+
+	// A dry run previews the patch, so it does not need to run inside a pipeline
+	if viper.GetBool(dryRunOptionName) || sonarutil.AppropriateToScan() {
+		pipelineExtender := pipeline.NewPatcher(sourceDir, options.Context, options.SQServer, options.APIKey, options.ScanOnPreview, options.ScanOnRelease, options.ScanOnFeature)
+		pipelineExtender.SetOptionProvenance(provenance)
+		pipelineExtender.SetDryRun(viper.GetBool(dryRunOptionName))
+		pipelineExtender.SetAllContexts(viper.GetBool(allContextsOptionName))
+		pipelineExtender.SetOrgDefaults(viper.GetString(orgDefaultsOptionName))
+		pipelineExtender.SetPolicy(viper.GetString(policyOptionName))
+		pipelineExtender.SetBuildPacks(viper.GetString(buildPacksOptionName))
+		err = pipelineExtender.SetOutput(viper.GetString(outputOptionName))
+		if err != nil {
+			configureCmdLogger.Fatal(err)
+		}
+		err = pipelineExtender.ConfigurePipeline()
 		if err != nil {
 			configureCmdLogger.Fatal(err)
 		}
 	}
 }
 
-func verify() sonarutil.MultiError {
+func verify(options pipeline.Options) sonarutil.MultiError {
 	validationErrors := sonarutil.MultiError{}
 
-	validationErrors.Collect(sonarutil.IsNotEmpty(viper.GetString(sqServerOptionName), sqServerOptionName))
+	validationErrors.Collect(sonarutil.IsNotEmpty(options.SQServer, sqServerOptionName))
 
 	return validationErrors
 }
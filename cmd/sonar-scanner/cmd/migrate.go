@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/jenkins-x-apps/jx-app-sonar-scanner/internal/logging"
+	"github.com/jenkins-x-apps/jx-app-sonar-scanner/internal/pipeline"
+	sonarutil "github.com/jenkins-x-apps/jx-app-sonar-scanner/internal/util"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	migrateCmdLogger = logging.AppLogger().WithFields(log.Fields{"command": "migrate-config"})
+
+	migrateCmd = &cobra.Command{
+		Use:   "migrate-config [file]",
+		Short: "rewrites a .jx-app-sonar-scanner.yaml file in place in the latest format, keeping its comments",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   migrate,
+	}
+	migrateDryRun bool
+)
+
+func init() {
+	migrateCmd.Flags().BoolVar(&migrateDryRun, dryRunOptionName, false, "Print the migrated file instead of writing it.")
+}
+
+func migrate(cmd *cobra.Command, args []string) {
+	file := filepath.Join(sourceDir, ".jx-app-sonar-scanner.yaml")
+	if len(args) > 0 {
+		file = args[0]
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		migrateCmdLogger.Fatalf("unable to read '%s': %s", file, err)
+	}
+
+	migrated, changed, err := pipeline.MigrateUserOverrides(content)
+	if err != nil {
+		migrateCmdLogger.Fatal(errors.Wrapf(err, "unable to migrate '%s'", file))
+	}
+	if migrateDryRun {
+		fmt.Print(string(migrated))
+		return
+	}
+	if !changed {
+		fmt.Printf("%s: already %s\n", file, pipeline.UserOverridesAPIVersion)
+		return
+	}
+
+	err = sonarutil.WriteFileAtomic(file, migrated, func(path string) error {
+		written, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if problems := pipeline.ValidateUserOverrides(written); len(problems) > 0 {
+			return errors.Errorf("migrated file is invalid: %s", problems[0])
+		}
+		return nil
+	})
+	if err != nil {
+		migrateCmdLogger.Fatal(errors.Wrapf(err, "unable to write '%s'", file))
+	}
+	fmt.Printf("%s: migrated to %s\n", file, pipeline.UserOverridesAPIVersion)
+}
@@ -38,6 +38,8 @@ func init() {
 	viper.SetDefault(logLevelOptionName, "info")
 
 	rootCmd.AddCommand(configureCmd)
+	rootCmd.AddCommand(migrateCmd)
+	rootCmd.AddCommand(validateCmd)
 	rootCmd.AddCommand(versionCmd)
 }
 
@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/jenkins-x-apps/jx-app-sonar-scanner/internal/logging"
+	"github.com/jenkins-x-apps/jx-app-sonar-scanner/internal/pipeline"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	printSchemaOptionName = "print-schema"
+)
+
+var (
+	validateCmdLogger = logging.AppLogger().WithFields(log.Fields{"command": "validate"})
+
+	validateCmd = &cobra.Command{
+		Use:   "validate [file]",
+		Short: "validates a .jx-app-sonar-scanner.yaml file, reporting the line and column of every problem",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   validate,
+	}
+	printSchema bool
+)
+
+func init() {
+	validateCmd.Flags().BoolVar(&printSchema, printSchemaOptionName, false, "Print the JSON Schema of the file instead of validating it.")
+}
+
+func validate(cmd *cobra.Command, args []string) {
+	if printSchema {
+		schema, err := pipeline.UserOverridesSchema()
+		if err != nil {
+			validateCmdLogger.Fatal(err)
+		}
+		fmt.Print(string(schema))
+		return
+	}
+
+	file := filepath.Join(sourceDir, ".jx-app-sonar-scanner.yaml")
+	if len(args) > 0 {
+		file = args[0]
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		validateCmdLogger.Fatalf("unable to read '%s': %s", file, err)
+	}
+
+	problems := pipeline.ValidateUserOverrides(content)
+	for _, problem := range problems {
+		fmt.Printf("%s:%s\n", file, problem)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("%s: ok\n", file)
+}
@@ -1,5 +1,7 @@
 #!/bin/bash
-while getopts s:k:r:p:v: option
+# Analysis properties from .jx-app-sonar-scanner.yaml, passed to the scanner on top of sonar-project.properties
+SCANNER_PROPERTIES=()
+while getopts s:k:r:p:f:v:x:t:d: option
 do
 case "${option}"
 in
@@ -7,13 +9,24 @@ s) export SONARQUBE_SERVER=${OPTARG};;
 k) export SONAR_TOKEN=${OPTARG};;
 r) export SCAN_ON_RELEASE=${OPTARG};;
 p) export SCAN_ON_PREVIEW=${OPTARG};;
+f) export SCAN_ON_FEATURE=${OPTARG};;
 v) export SCANNER_VERBOSE=${OPTARG};;
-*) echo "usage: $0 [-s server] [-k token] [-r] [-p] [-v]"
+x) export PROJECT_KEY_SUFFIX=${OPTARG};;
+t) export PROPERTIES_TEMPLATE=${OPTARG};;
+d) SCANNER_PROPERTIES+=("-D${OPTARG}");;
+*) echo "usage: $0 [-s server] [-k token] [-r] [-p] [-f] [-v] [-x project key suffix] [-t properties template] [-d key=value]..."
 esac
 done
 
+# Each build context of a repository is reported as a project of its own
+PROJECT_KEY="${JOB_NAME}"
+if [[ -n "${PROJECT_KEY_SUFFIX}" ]] ; then
+    PROJECT_KEY="${JOB_NAME}-${PROJECT_KEY_SUFFIX}"
+fi
+
 unset IS_PREVIEW_PIPELINE
 unset IS_RELEASE_PIPELINE
+unset IS_FEATURE_PIPELINE
 # Try and establish what phase of what type of build pipeline we are in
 [[ "${PIPELINE_KIND}" == "pullrequest" ]] && [ ! -f .pre-commit-config.yaml ] && IS_PREVIEW_PIPELINE="true" || IS_PREVIEW_PIPELINE="false"
 if [[ ${IS_PREVIEW_PIPELINE} == "true" ]] ; then
@@ -23,6 +36,10 @@ fi
 if [[ ${IS_RELEASE_PIPELINE} == "true" ]] ; then
     echo "Detected Release pipeline";
 fi
+[[ "$PIPELINE_KIND" == "feature" ]] && [ ! -f .pre-commit-config.yaml ] && IS_FEATURE_PIPELINE="true" || IS_FEATURE_PIPELINE="false"
+if [[ ${IS_FEATURE_PIPELINE} == "true" ]] ; then
+    echo "Detected Feature pipeline";
+fi
 if [[ ${SCANNER_VERBOSE} == "true" ]] ; then
     env
     ls -laR
@@ -30,21 +47,32 @@ fi
 if [[ -f "sonar-project.properties" ]]; then
     echo "Using sonar-project.properties file from project source app=jx-app-sonar-scanner sonarscanproperties=true"
 fi
+# The build pack registry may name another template than the one named after the build pack
+PROPERTIES_TEMPLATE="${PROPERTIES_TEMPLATE:-${BUILDPACK_NAME}.sonar-project.properties}"
+if [[ "${PROPERTIES_TEMPLATE}" != /* ]]; then
+    PROPERTIES_TEMPLATE="/sqproperties/${PROPERTIES_TEMPLATE}"
+fi
 if [[ ! -f "sonar-project.properties" ]]; then
-    echo "Setting up default sonar-project.properties file for buildpack ${BUILDPACK_NAME}"
-    cp "/sqproperties/${BUILDPACK_NAME}.sonar-project.properties" sonar-project.properties || true
+    echo "Setting up default sonar-project.properties file for buildpack ${BUILDPACK_NAME} from ${PROPERTIES_TEMPLATE}"
+    cp "${PROPERTIES_TEMPLATE}" sonar-project.properties || true
 fi
 if [[ ${SCANNER_VERBOSE} == "true" ]] && [ -f "sonar-project.properties" ]; then
     cat sonar-project.properties
 fi
+if [[ ${#SCANNER_PROPERTIES[@]} -gt 0 ]]; then
+    echo "Adding ${#SCANNER_PROPERTIES[@]} properties from .jx-app-sonar-scanner.yaml app=jx-app-sonar-scanner sonarscanproperties=true"
+    if [[ ${SCANNER_VERBOSE} == "true" ]] ; then
+        printf '%s\n' "${SCANNER_PROPERTIES[@]}"
+    fi
+fi
 
 # Only activate in preview builds or the first stage of a release
-if [[ ${IS_PREVIEW_PIPELINE} == "true" ]] || [[ ${IS_RELEASE_PIPELINE} == "true" ]] ; then
+if [[ ${IS_PREVIEW_PIPELINE} == "true" ]] || [[ ${IS_RELEASE_PIPELINE} == "true" ]] || [[ ${IS_FEATURE_PIPELINE} == "true" ]] ; then
     if [[ ${IS_PREVIEW_PIPELINE} == "true" ]] ; then
         if [[ ${SCAN_ON_PREVIEW} == "true" ]] ; then
             echo "Sonarqube is scanning files..."
             echo "BuildPack: ${BUILDPACK_NAME}"
-            /opt/sonar/bin/sonar-scanner "-Dsonar.host.url=${SONARQUBE_SERVER}" "-Dsonar.projectKey=${JOB_NAME}" "-Dsonar.login=${SONAR_TOKEN}" "-Dsonar.scm.provider=git"
+            /opt/sonar/bin/sonar-scanner "-Dsonar.host.url=${SONARQUBE_SERVER}" "-Dsonar.projectKey=${PROJECT_KEY}" "-Dsonar.login=${SONAR_TOKEN}" "-Dsonar.scm.provider=git" "${SCANNER_PROPERTIES[@]}"
         else
             echo "Sonarqube scanning disabled in preview builds."
         fi
@@ -53,11 +81,20 @@ if [[ ${IS_PREVIEW_PIPELINE} == "true" ]] || [[ ${IS_RELEASE_PIPELINE} == "true"
         if [[ ${SCAN_ON_RELEASE} == "true" ]] ; then
             echo "Sonarqube is scanning files..."
             echo "BuildPack: ${BUILDPACK_NAME}"
-            /opt/sonar/bin/sonar-scanner "-Dsonar.host.url=${SONARQUBE_SERVER}" "-Dsonar.projectKey=${JOB_NAME}" "-Dsonar.login=${SONAR_TOKEN}" "-Dsonar.scm.provider=git"
+            /opt/sonar/bin/sonar-scanner "-Dsonar.host.url=${SONARQUBE_SERVER}" "-Dsonar.projectKey=${PROJECT_KEY}" "-Dsonar.login=${SONAR_TOKEN}" "-Dsonar.scm.provider=git" "${SCANNER_PROPERTIES[@]}"
         else
             echo "Sonarqube scanning disabled in release builds."
         fi
     fi
+    if [[ ${IS_FEATURE_PIPELINE} == "true" ]] ; then
+        if [[ ${SCAN_ON_FEATURE} == "true" ]] ; then
+            echo "Sonarqube is scanning files..."
+            echo "BuildPack: ${BUILDPACK_NAME}"
+            /opt/sonar/bin/sonar-scanner "-Dsonar.host.url=${SONARQUBE_SERVER}" "-Dsonar.projectKey=${PROJECT_KEY}" "-Dsonar.login=${SONAR_TOKEN}" "-Dsonar.scm.provider=git" "${SCANNER_PROPERTIES[@]}"
+        else
+            echo "Sonarqube scanning disabled in feature builds."
+        fi
+    fi
 else
     echo "Skipping sonarqube scan"
 fi
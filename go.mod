@@ -1,6 +1,6 @@
 module github.com/jenkins-x-apps/jx-app-sonar-scanner
 
-go 1.12
+go 1.16
 
 require (
 	github.com/GeertJohan/fgt v0.0.0-20160120143236-262f7b11eec0 // indirect
@@ -10,12 +10,15 @@ require (
 	github.com/jenkins-x/jx/v2 v2.1.84
 	github.com/magiconair/properties v1.8.0
 	github.com/pkg/errors v0.9.1
+	github.com/pmezard/go-difflib v1.0.0
 	github.com/sirupsen/logrus v1.6.0
 	github.com/spf13/cobra v0.0.5
+	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.4.0
 	github.com/stretchr/testify v1.6.0
 	github.com/udhos/equalfile v0.3.0
 	gopkg.in/yaml.v2 v2.2.8
+	gopkg.in/yaml.v3 v3.0.1
 	k8s.io/client-go v11.0.1-0.20190805182717-6502b5e7b1b5+incompatible
 )
 
@@ -1,8 +1,10 @@
 package logging
 
 import (
-	log "github.com/sirupsen/logrus"
+	"io"
 	"os"
+
+	log "github.com/sirupsen/logrus"
 )
 
 const (
@@ -24,6 +26,12 @@ func AppLogger() *log.Entry {
 	return logger
 }
 
+// Output returns the writer the log goes to, for progress messages that are not log entries. It is stdout
+// unless a command keeps stdout for its results.
+func Output() io.Writer {
+	return log.StandardLogger().Out
+}
+
 // SetLevel sets the logging level
 func SetLevel(s string) error {
 	level, err := log.ParseLevel(s)
@@ -0,0 +1,265 @@
+package pipeline
+
+import (
+	_ "embed"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/jenkins-x-apps/jx-app-sonar-scanner/internal/util"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v3"
+)
+
+const (
+	// DefaultBuildPacksFile is where additional build packs are read from unless another file is given,
+	// typically a mounted ConfigMap
+	DefaultBuildPacksFile = "/etc/jx-app-sonar-scanner/buildpacks.yaml"
+
+	// BuildPacksKind is the kind of document held by a build pack registry
+	BuildPacksKind = "SonarScannerBuildPacks"
+
+	// propertiesTemplateSuffix names the sonar-project.properties template of a build pack after the build pack
+	propertiesTemplateSuffix = ".sonar-project.properties"
+)
+
+// defaultBuildPacks is the registry of the build packs recognised out of the box
+//
+//go:embed buildpacks.yaml
+var defaultBuildPacks []byte
+
+// BuildPack describes how to scan the pipelines of one build pack
+type BuildPack struct {
+	Name string `yaml:"-"`
+	// Properties is the sonar-project.properties template used when the repository has none, either a
+	// file of /sqproperties or an absolute path
+	Properties string `yaml:"properties,omitempty"`
+	// PullRequest, Release and Feature list the anchors of the scan in each kind of pipeline, in order of
+	// preference. The scan goes at the first anchor found in the pipeline.
+	PullRequest BuildSteps `yaml:"pullRequest,omitempty"`
+	Release     BuildSteps `yaml:"release,omitempty"`
+	Feature     BuildSteps `yaml:"feature,omitempty"`
+
+	// detection is set when the build pack was guessed from the source tree
+	detection *Detection
+}
+
+// BuildPacks is a registry of build packs by name
+type BuildPacks map[string]BuildPack
+
+// anchors returns where the scan may go in the given kind of pipeline, in order of preference
+func (b BuildPack) anchors(pipeline string) BuildSteps {
+	switch pipeline {
+	case "pullRequest":
+		return b.PullRequest
+	case "release":
+		return b.Release
+	case "feature":
+		return b.Feature
+	default:
+		return nil
+	}
+}
+
+// template returns the properties template to pass to the scan, or an empty string when the scanner
+// script finds it by itself from the build pack name
+func (b BuildPack) template() string {
+	if b.Properties == b.Name+propertiesTemplateSuffix {
+		return ""
+	}
+	return b.Properties
+}
+
+// lookup returns the build pack of the given name. A namespaced name, such as my-org/packs/go, that is not
+// in the registry matches the build pack named by its last elements, go in this case. A build pack missing
+// from the registry has no anchors.
+func (r BuildPacks) lookup(name string) BuildPack {
+	if buildPack, ok := r[name]; ok {
+		return buildPack
+	}
+	for suffix := name; strings.Contains(suffix, "/"); {
+		suffix = suffix[strings.Index(suffix, "/")+1:]
+		if buildPack, ok := r[suffix]; ok {
+			logger.Debugf("buildPack %s matches build pack %s", name, suffix)
+			return buildPack
+		}
+	}
+	return BuildPack{Name: name}
+}
+
+// buildPacksSchema describes a build pack registry
+func buildPacksSchema() *schema {
+	anchors := func(pipeline string) *schema {
+		anchor := &schema{
+			Type:        schemaTypeObject,
+			Description: fmt.Sprintf("Where to insert the scan in %s pipelines.", pipeline),
+			Required:    []string{"stage"},
+			Properties: map[string]*schema{
+				"stage": {
+					Type:        schemaTypeString,
+					Description: "The stage, or path of nested stages separated by /, to anchor the scan to. Prefix with glob: or regex: to match loosely.",
+				},
+				"step": {
+					Type:        schemaTypeString,
+					Description: "The step to anchor the scan to. Prefix with glob: or regex: to match loosely.",
+				},
+				"position": {
+					Type:        schemaTypeString,
+					Description: "Where to insert the scan relative to the stage and step.",
+					Enum:        []string{PositionAfter, PositionBefore, PositionFirstInStage, PositionLastInStage, PositionNewStage},
+				},
+			},
+		}
+		return &schema{
+			Description: fmt.Sprintf("Where to insert the scan in %s pipelines, or a list of places tried in order.", pipeline),
+			OneOf: []*schema{
+				anchor,
+				{
+					Type:  schemaTypeArray,
+					Items: anchor,
+				},
+			},
+		}
+	}
+	return &schema{
+		Type:        schemaTypeObject,
+		Description: "A registry of the build packs jx-app-sonar-scanner recognises.",
+		Required:    []string{"apiVersion", "kind"},
+		Properties: map[string]*schema{
+			"apiVersion": {
+				Type:        schemaTypeString,
+				Description: "The version of the file format.",
+				Enum:        []string{UserOverridesAPIVersion},
+			},
+			"kind": {
+				Type:        schemaTypeString,
+				Description: "The kind of document.",
+				Enum:        []string{BuildPacksKind},
+			},
+			"spec": {
+				Type:        schemaTypeObject,
+				Description: "The registry.",
+				Properties: map[string]*schema{
+					"buildPacks": {
+						Type:        schemaTypeObject,
+						Description: "The build packs by name, as given by buildPack in the effective pipeline.",
+						AdditionalProperties: &schema{
+							Type:          schemaTypeObject,
+							MinProperties: 1,
+							Properties: map[string]*schema{
+								"properties": {
+									Type:        schemaTypeString,
+									Description: "The sonar-project.properties template used when the repository has none, a file of /sqproperties or an absolute path.",
+								},
+								"pullRequest": anchors("pull request"),
+								"release":     anchors("release"),
+								"feature":     anchors("feature branch"),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// loadBuildPacks reads the built-in registry, and merges the registry in file over it if there is such a
+// file. Build packs in the file replace the anchors and template they set. Every build pack must end up
+// with an anchor for each kind of pipeline.
+func loadBuildPacks(file string) (BuildPacks, error) {
+	registry, err := parseBuildPacks(defaultBuildPacks)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid built-in build packs")
+	}
+	if file != "" && util.Exists(file) {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Errorf("failed to open '%s'", file)
+		}
+		extra, err := parseBuildPacks(content)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to parse '%s'", file)
+		}
+		for name, buildPack := range extra {
+			// A new namespaced build pack starts from the one it is named after, but keeps its own name
+			base := registry.lookup(name)
+			base.Name = name
+			registry[name] = base.merge(buildPack)
+			logger.Debugf("build pack %s from '%s'", name, file)
+		}
+		err = registry.complete()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid build packs in '%s'", file)
+		}
+	}
+	return registry, nil
+}
+
+// parseBuildPacks validates and decodes a build pack registry
+func parseBuildPacks(content []byte) (BuildPacks, error) {
+	doc := &yaml.Node{}
+	err := yaml.Unmarshal(content, doc)
+	if err != nil {
+		return nil, problemsError([]Problem{yamlProblem(err)})
+	}
+	root := rootNode(doc)
+	if root == nil || root.Kind == 0 {
+		return BuildPacks{}, nil
+	}
+	problems := []Problem{}
+	buildPacksSchema().validate(root, "", &problems)
+	if len(problems) > 0 {
+		return nil, problemsError(problems)
+	}
+	registry := struct {
+		BuildPacks BuildPacks `yaml:"buildPacks"`
+	}{}
+	if spec := mappingValue(root, "spec"); spec != nil {
+		err = spec.Decode(&registry)
+		if err != nil {
+			return nil, err
+		}
+	}
+	buildPacks := BuildPacks{}
+	for name, buildPack := range registry.BuildPacks {
+		buildPack.Name = name
+		buildPacks[name] = buildPack
+	}
+	return buildPacks, nil
+}
+
+// merge returns the build pack with the anchors and template set by other replacing its own. A list of
+// anchors is replaced as a whole.
+func (b BuildPack) merge(other BuildPack) BuildPack {
+	if other.Properties != "" {
+		b.Properties = other.Properties
+	}
+	if len(other.PullRequest) > 0 {
+		b.PullRequest = other.PullRequest
+	}
+	if len(other.Release) > 0 {
+		b.Release = other.Release
+	}
+	if len(other.Feature) > 0 {
+		b.Feature = other.Feature
+	}
+	return b
+}
+
+// complete checks that every build pack has an anchor for each kind of pipeline
+func (r BuildPacks) complete() error {
+	names := []string{}
+	for name := range r {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, pipeline := range []string{"pullRequest", "release", "feature"} {
+			if len(r[name].anchors(pipeline)) == 0 {
+				return errors.Errorf("build pack '%s' has no anchor for %s pipelines", name, pipeline)
+			}
+		}
+	}
+	return nil
+}
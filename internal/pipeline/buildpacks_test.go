@@ -0,0 +1,82 @@
+package pipeline
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_loadBuildPacks_default(t *testing.T) {
+	registry, err := loadBuildPacks("../../test/buildpacks/absent.yaml")
+	assert.NoError(t, err)
+	assert.NoError(t, registry.complete())
+	assert.Len(t, registry, 11)
+	assert.Equal(t, BuildPack{
+		Name:        "maven",
+		Properties:  "maven.sonar-project.properties",
+		PullRequest: BuildSteps{{Stage: "from-build-pack", Step: "build-mvn-install"}, {Stage: "from-build-pack", Step: "build-mvn-verify"}},
+		Release:     BuildSteps{{Stage: "from-build-pack", Step: "build-mvn-deploy"}, {Stage: "from-build-pack", Step: "build-mvn-install"}},
+		Feature:     BuildSteps{{Stage: "from-build-pack", Step: "build-mvn-install"}, {Stage: "from-build-pack", Step: "build-mvn-verify"}},
+	}, registry["maven"])
+}
+
+func Test_loadBuildPacks_merged(t *testing.T) {
+	registry, err := loadBuildPacks("../../test/custom-buildpack/buildpacks.yaml")
+	assert.NoError(t, err)
+	assert.Len(t, registry, 12)
+	assert.Equal(t, BuildSteps{{Stage: "from-build-pack", Step: "build-make-build", Position: PositionBefore}}, registry["my-go"].anchors("release"))
+	assert.Equal(t, BuildSteps{{Stage: "from-build-pack", Step: "build-make-linux"}, {Stage: "from-build-pack", Step: "build-make-build"}}, registry["my-go"].anchors("pullRequest"))
+	assert.Equal(t, "go.sonar-project.properties", registry["my-go"].template())
+
+	// Only the release anchors of maven are replaced, as a whole
+	assert.Equal(t, BuildSteps{{Stage: "from-build-pack", Step: "build-mvn-deploy", Position: PositionBefore}}, registry["maven"].anchors("release"))
+	assert.Equal(t, BuildSteps{{Stage: "from-build-pack", Step: "build-mvn-install"}, {Stage: "from-build-pack", Step: "build-mvn-verify"}}, registry["maven"].anchors("pullRequest"))
+	assert.Equal(t, "", registry["maven"].template())
+}
+
+func Test_loadBuildPacks_invalid(t *testing.T) {
+	_, err := loadBuildPacks("../../test/buildpacks/broken.yaml")
+	assert.EqualError(t, err, "unable to parse '../../test/buildpacks/broken.yaml': 8:17: expected 'spec.buildPacks.rust.pullRequest' to set 'stage'; 9:27: invalid value 'middle' for 'spec.buildPacks.rust.pullRequest.position', expected one of: after, before, first-in-stage, last-in-stage, new-stage")
+
+	_, err = loadBuildPacks("../../test/buildpacks/incomplete.yaml")
+	assert.EqualError(t, err, "invalid build packs in '../../test/buildpacks/incomplete.yaml': build pack 'rust' has no anchor for release pipelines")
+}
+
+func TestBuildPacks_lookup(t *testing.T) {
+	registry, err := loadBuildPacks("")
+	assert.NoError(t, err)
+	assert.Equal(t, BuildSteps{{Stage: "build", Step: "flake8"}}, registry.lookup("ml-python-gpu-training").anchors("release"))
+
+	unknown := registry.lookup("rust")
+	assert.Equal(t, "rust", unknown.Name)
+	assert.Empty(t, unknown.anchors("pullRequest"))
+	assert.Equal(t, "", unknown.template())
+}
+
+func TestBuildPacks_lookup_namespaced(t *testing.T) {
+	registry, err := loadBuildPacks("../../test/custom-buildpack/buildpacks.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, "go", registry.lookup("packs/go").Name)
+	assert.Equal(t, "go", registry.lookup("acme/packs/go").Name)
+	assert.Equal(t, "my-go", registry.lookup("acme/my-go").Name)
+	assert.Equal(t, "acme/rust", registry.lookup("acme/rust").Name)
+	assert.Empty(t, registry.lookup("acme/rust").anchors("release"))
+}
+
+func Test_loadBuildPacks_namespaced(t *testing.T) {
+	registry, err := loadBuildPacks("../../test/buildpacks/namespaced.yaml")
+	assert.NoError(t, err)
+	assert.Len(t, registry, 12)
+
+	buildPack := registry.lookup("acme/go")
+	assert.Equal(t, "acme/go", buildPack.Name)
+	assert.Equal(t, BuildSteps{{Stage: "from-build-pack", Step: "build-make-release"}}, buildPack.anchors("release"))
+	assert.Equal(t, registry["go"].anchors("pullRequest"), buildPack.anchors("pullRequest"))
+	// The template of go is passed on, as the script would otherwise look for acme/go's own
+	assert.Equal(t, "go.sonar-project.properties", buildPack.template())
+
+	// The built-in build pack it is named after is left alone
+	assert.Equal(t, "go", registry["go"].Name)
+	assert.Equal(t, BuildSteps{{Stage: "from-build-pack", Step: "build-make-build"}, {Stage: "from-build-pack", Step: "build-make-linux"}}, registry["go"].anchors("release"))
+	assert.Equal(t, "go", registry.lookup("other/go").Name)
+}
@@ -0,0 +1,297 @@
+package pipeline
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jenkins-x-apps/jx-app-sonar-scanner/internal/util"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v3"
+)
+
+const (
+	// DefaultOrgDefaultsFile is where the org-wide defaults are read from unless another file is given,
+	// typically a mounted ConfigMap
+	DefaultOrgDefaultsFile = "/etc/jx-app-sonar-scanner/defaults.yaml"
+
+	// envPrefix prefixes the environment variables that override single settings
+	envPrefix = "SONAR_SCANNER_"
+)
+
+// Provenance records, for each effective setting, its value and the layer of configuration it came from.
+// Settings no layer sets come from the built-in "default".
+type Provenance map[string]Source
+
+// Source is the value of a setting and where it came from
+type Source struct {
+	Value string
+	Layer string
+}
+
+// configLayer is one source of settings. Layers are merged in order, later layers overriding earlier ones.
+type configLayer struct {
+	node *yaml.Node
+	// legacy is set for a file in the unversioned format
+	legacy bool
+	// source names where a setting came from, given its path
+	source func(path string) string
+}
+
+// getUserOverrides merges the org defaults, the repo override file and the environment, in that order,
+// into the effective user overrides, recording where each setting came from. The org policy, if there is
+// one, removes the settings the repository may not override from the last two. The rollout is never taken
+// from the repo override file.
+func (e *Patcher) getUserOverrides(file string) (UserOverrides, Provenance, error) {
+	userOverrides := UserOverrides{}
+	layers := []configLayer{}
+
+	policy, err := e.activePolicy()
+	if err != nil {
+		return userOverrides, nil, err
+	}
+
+	if e.orgDefaults != "" {
+		layer, err := fileLayer("org defaults", e.orgDefaults, validateOrgDefaults)
+		if err != nil {
+			return userOverrides, nil, err
+		}
+		if layer != nil {
+			layers = append(layers, *layer)
+		} else {
+			logger.Debugf("no org defaults found at '%s'", e.orgDefaults)
+		}
+	}
+
+	layer, err := fileLayer("repo", filepath.Join(e.sourceDir, file), ValidateUserOverrides)
+	if err != nil {
+		return userOverrides, nil, err
+	}
+	e.looseMatch = layer != nil && layer.legacy
+	if layer != nil {
+		if policy != nil {
+			*layer = policy.enforce(*layer, e.repoName())
+		}
+		layers = append(layers, *layer)
+	}
+
+	layer, err = envLayer(e.getenv)
+	if err != nil {
+		return userOverrides, nil, err
+	}
+	if policy != nil {
+		*layer = policy.enforce(*layer, e.repoName())
+	}
+	layers = append(layers, *layer)
+
+	merged := newMappingNode()
+	provenance := Provenance{}
+	for _, setting := range settingsSchema().settings("") {
+		value := ""
+		if scalar := setting.schema.scalar(); scalar != nil && scalar.Type == schemaTypeBoolean {
+			value = "false"
+		}
+		provenance[setting.path] = Source{Value: value, Layer: "default"}
+	}
+	for _, layer := range layers {
+		mergeNodes(merged, layer.node, settingsSchema(), "", func(path string, value *yaml.Node) {
+			provenance[path] = Source{Value: describeValue(value), Layer: layer.source(path)}
+		})
+	}
+	if policy != nil {
+		policy.lockProvenance(provenance)
+	}
+
+	err = merged.Decode(&userOverrides)
+	if err != nil {
+		return UserOverrides{}, nil, errors.Wrap(err, "unable to decode merged configuration")
+	}
+	return userOverrides, provenance, nil
+}
+
+// fileLayer reads a layer from a file in the user overrides format, checked by validate, or returns nil if
+// there is no such file
+func fileLayer(name string, path string, validate func([]byte) []Problem) (*configLayer, error) {
+	if !util.Exists(path) {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Errorf("failed to open '%s'", path)
+	}
+	problems := validate(content)
+	if len(problems) > 0 {
+		return nil, errors.Wrapf(problemsError(problems), "unable to parse '%s'", path)
+	}
+	doc := &yaml.Node{}
+	err = yaml.Unmarshal(content, doc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse '%s'", path)
+	}
+	spec := newMappingNode()
+	legacy := false
+	if doc.Kind != 0 {
+		root := rootNode(doc)
+		if root != nil && isLegacy(root) && root.Kind == yaml.MappingNode && len(root.Content) > 0 {
+			legacy = true
+			logger.Infof("'%s' uses the unversioned format, run 'sonar-scanner migrate-config' to upgrade it to %s", path, UserOverridesAPIVersion)
+		}
+		if node := specNode(root); node != nil {
+			spec = node
+		}
+	}
+	source := fmt.Sprintf("%s (%s)", name, path)
+	return &configLayer{node: spec, legacy: legacy, source: func(string) string { return source }}, nil
+}
+
+// envLayer builds a layer from the environment variables named after single valued settings, such
+// as SONAR_SCANNER_VERBOSE for verbose or SONAR_SCANNER_PULLREQUEST_STAGE for pullRequest.stage
+func envLayer(getenv func(string) string) (*configLayer, error) {
+	root := newMappingNode()
+	for _, setting := range settingsSchema().settings("") {
+		scalar := setting.schema.scalar()
+		if scalar == nil {
+			continue
+		}
+		name := envName(setting.path)
+		value := getenv(name)
+		if value == "" {
+			continue
+		}
+		node := newStringNode(value)
+		if scalar.Type == schemaTypeBoolean {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, errors.Errorf("invalid value '%s' for %s, expected true or false", value, name)
+			}
+			node = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(b)}
+		}
+		if len(scalar.Enum) > 0 && !util.Contains(scalar.Enum, value) {
+			return nil, errors.Errorf("invalid value '%s' for %s, expected one of: %s", value, name, strings.Join(scalar.Enum, ", "))
+		}
+		setPath(root, strings.Split(setting.path, "."), node)
+	}
+	return &configLayer{node: root, source: func(path string) string {
+		return fmt.Sprintf("env (%s)", envName(path))
+	}}, nil
+}
+
+// envName returns the environment variable that overrides the setting at path
+func envName(path string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(path, ".", "_", -1))
+}
+
+type setting struct {
+	path   string
+	schema *schema
+}
+
+// settings lists the settings below an object, that is the strings, booleans and lists, in a stable order
+func (s *schema) settings(path string) []setting {
+	switch {
+	case s.AdditionalProperties != nil:
+		// The keys of a map are only known once it is set
+		return nil
+	case len(s.OneOf) > 0 && s.scalar() == nil:
+		// Settings that are given either as an object or a list are set one by one through the object
+		return s.alternative(&yaml.Node{Kind: yaml.MappingNode}).settings(path)
+	case s.Type == schemaTypeObject:
+		settings := []setting{}
+		for _, name := range s.propertyNames() {
+			child := name
+			if path != "" {
+				child = path + "." + name
+			}
+			settings = append(settings, s.Properties[name].settings(child)...)
+		}
+		return settings
+	default:
+		return []setting{{path: path, schema: s}}
+	}
+}
+
+// setPath stores value at the given path of nested mappings, creating them as needed
+func setPath(node *yaml.Node, path []string, value *yaml.Node) {
+	if len(path) == 1 {
+		setMappingValue(node, path[0], value)
+		return
+	}
+	child := mappingValue(node, path[0])
+	if child == nil || child.Kind != yaml.MappingNode {
+		child = newMappingNode()
+		setMappingValue(node, path[0], child)
+	}
+	setPath(child, path[1:], value)
+}
+
+// mergeNodes merges the mapping src, described by s, into dst. Nested objects are merged, anything else
+// replaces what dst holds. record is told the path of every
+// value taken from src.
+func mergeNodes(dst *yaml.Node, src *yaml.Node, s *schema, path string, record func(path string, value *yaml.Node)) {
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, value := src.Content[i].Value, src.Content[i+1]
+		if value.Kind == yaml.AliasNode {
+			value = value.Alias
+		}
+		if value.Kind == yaml.ScalarNode && value.Tag == "!!null" {
+			continue
+		}
+		child := key
+		if path != "" {
+			child = path + "." + key
+		}
+		existing := mappingValue(dst, key)
+		property := s.property(key)
+		if property != nil && len(property.OneOf) > 0 {
+			property = property.alternative(value)
+		}
+		if property != nil && property.Type == schemaTypeObject && value.Kind == yaml.MappingNode {
+			if existing == nil || existing.Kind != yaml.MappingNode {
+				existing = newMappingNode()
+				setMappingValue(dst, key, existing)
+			}
+			mergeNodes(existing, value, property, child, record)
+			continue
+		}
+		setMappingValue(dst, key, value)
+		record(child, value)
+	}
+}
+
+// logProvenance prints every effective setting and where it came from at debug level
+func logProvenance(provenance Provenance) {
+	paths := []string{}
+	for path := range provenance {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		logger.Debugf("setting %s=%s from %s", path, provenance[path].Value, provenance[path].Layer)
+	}
+}
+
+// describeValue renders a setting for the log
+func describeValue(node *yaml.Node) string {
+	if node.Kind == yaml.ScalarNode {
+		return node.Value
+	}
+	flow := *node
+	flow.Style = yaml.FlowStyle
+	content, err := yaml.Marshal(&flow)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// problemsError joins schema problems into a single error
+func problemsError(problems []Problem) error {
+	messages := []string{}
+	for _, problem := range problems {
+		messages = append(messages, problem.String())
+	}
+	return errors.New(strings.Join(messages, "; "))
+}
@@ -0,0 +1,113 @@
+package pipeline
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPatcher_getUserOverrides_layers(t *testing.T) {
+	tests := []struct {
+		name           string
+		orgDefaults    string
+		env            map[string]string
+		want           UserOverrides
+		wantProvenance map[string]Source
+		wantErr        string
+	}{
+		{
+			name:        "repo overrides org defaults",
+			orgDefaults: "../../test/org-defaults/defaults.yaml",
+			want: UserOverrides{
+				Verbose:     true,
+				PullRequest: BuildSteps{{Stage: "ci", Step: "make-build", Position: PositionAfter}},
+				Release:     BuildSteps{{Stage: "release", Step: "make-release", Position: PositionBefore}},
+				Rules:       SkipRules{Skip: []SkipRule{{Branch: "renovate/*"}}},
+			},
+			wantProvenance: map[string]Source{
+				"verbose":              {"true", "repo (../../test/user-properties/good.yaml)"},
+				"skip":                 {"false", "repo (../../test/user-properties/good.yaml)"},
+				"pullRequest.stage":    {"ci", "repo (../../test/user-properties/good.yaml)"},
+				"pullRequest.position": {"after", "org defaults (../../test/org-defaults/defaults.yaml)"},
+				"release.position":     {"before", "org defaults (../../test/org-defaults/defaults.yaml)"},
+				"rules.skip":           {"[{branch: renovate/*}]", "org defaults (../../test/org-defaults/defaults.yaml)"},
+				"feature.stage":        {"", "default"},
+				"paths.include":        {"", "default"},
+			},
+		},
+		{
+			name:        "env overrides repo",
+			orgDefaults: "../../test/org-defaults/defaults.yaml",
+			env: map[string]string{
+				"SONAR_SCANNER_VERBOSE":              "false",
+				"SONAR_SCANNER_PULLREQUEST_POSITION": "before",
+				"SONAR_SCANNER_FEATURE_STAGE":        "build",
+			},
+			want: UserOverrides{
+				PullRequest: BuildSteps{{Stage: "ci", Step: "make-build", Position: PositionBefore}},
+				Release:     BuildSteps{{Stage: "release", Step: "make-release", Position: PositionBefore}},
+				Feature:     BuildSteps{{Stage: "build"}},
+				Rules:       SkipRules{Skip: []SkipRule{{Branch: "renovate/*"}}},
+			},
+			wantProvenance: map[string]Source{
+				"verbose":              {"false", "env (SONAR_SCANNER_VERBOSE)"},
+				"pullRequest.stage":    {"ci", "repo (../../test/user-properties/good.yaml)"},
+				"pullRequest.position": {"before", "env (SONAR_SCANNER_PULLREQUEST_POSITION)"},
+				"feature.stage":        {"build", "env (SONAR_SCANNER_FEATURE_STAGE)"},
+			},
+		},
+		{
+			name:        "missing org defaults",
+			orgDefaults: "../../test/org-defaults/absent.yaml",
+			want: UserOverrides{
+				Verbose:     true,
+				PullRequest: BuildSteps{{Stage: "ci", Step: "make-build"}},
+				Release:     BuildSteps{{Stage: "release", Step: "make-release"}},
+			},
+			wantProvenance: map[string]Source{
+				"pullRequest.position": {"", "default"},
+				"rules.skip":           {"", "default"},
+			},
+		},
+		{
+			name:        "invalid org defaults",
+			orgDefaults: "../../test/org-defaults/broken.yaml",
+			wantErr:     "unable to parse '../../test/org-defaults/broken.yaml': 3:5: unknown field 'pullRequest.stag', expected one of: name, position, properties, stage, step",
+		},
+		{
+			name:    "invalid boolean in env",
+			env:     map[string]string{"SONAR_SCANNER_SKIP": "maybe"},
+			wantErr: "invalid value 'maybe' for SONAR_SCANNER_SKIP, expected true or false",
+		},
+		{
+			name:    "invalid position in env",
+			env:     map[string]string{"SONAR_SCANNER_RELEASE_POSITION": "later"},
+			wantErr: "invalid value 'later' for SONAR_SCANNER_RELEASE_POSITION, expected one of: after, before, first-in-stage, last-in-stage, new-stage",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := tt.env
+			e := &Patcher{
+				sourceDir:   "../../test/user-properties/",
+				orgDefaults: tt.orgDefaults,
+				env:         func(key string) string { return env[key] },
+			}
+			got, provenance, err := e.getUserOverrides("good.yaml")
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			for path, source := range tt.wantProvenance {
+				assert.Equal(t, source, provenance[path], path)
+			}
+		})
+	}
+}
+
+func Test_envName(t *testing.T) {
+	assert.Equal(t, "SONAR_SCANNER_VERBOSE", envName("verbose"))
+	assert.Equal(t, "SONAR_SCANNER_PULLREQUEST_STAGE", envName("pullRequest.stage"))
+}
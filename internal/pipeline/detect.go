@@ -0,0 +1,143 @@
+package pipeline
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/jenkins-x-apps/jx-app-sonar-scanner/internal/util"
+)
+
+// Confidence levels of a build pack detected from the source tree
+const (
+	// ConfidenceHigh means the build files of a single build pack were found
+	ConfidenceHigh = "high"
+	// ConfidenceMedium means the build files of several build packs were found, the first was chosen
+	ConfidenceMedium = "medium"
+	// ConfidenceLow means no build file was found, the build pack was guessed from the source files
+	ConfidenceLow = "low"
+)
+
+const (
+	// noBuildPack is the buildPack of a pipeline written without a build pack
+	noBuildPack = "none"
+
+	// detectDepth is how many directories below the root are searched for source files
+	detectDepth = 2
+)
+
+// Detection records the build pack guessed from the source tree of a pipeline without one
+type Detection struct {
+	BuildPack  string   `json:"buildPack"`
+	Confidence string   `json:"confidence"`
+	Evidence   []string `json:"evidence"`
+}
+
+func (d Detection) String() string {
+	return fmt.Sprintf("%s with %s confidence from %s", d.BuildPack, d.Confidence, strings.Join(d.Evidence, ", "))
+}
+
+// buildPackSignatures lists, from the most to the least specific, the build files at the root of the source
+// tree and the extensions of the source files that identify each build pack
+var buildPackSignatures = []struct {
+	buildPack  string
+	buildFiles []string
+	extensions []string
+	// implies names a build pack whose build files are expected alongside, and so are not a competing guess
+	implies string
+}{
+	{buildPack: "maven", buildFiles: []string{"pom.xml"}, extensions: []string{".java"}},
+	{buildPack: "gradle", buildFiles: []string{"build.gradle", "build.gradle.kts", "settings.gradle", "settings.gradle.kts"}, extensions: []string{".kt", ".groovy"}},
+	{buildPack: "scala", buildFiles: []string{"build.sbt"}, extensions: []string{".scala"}},
+	{buildPack: "go", buildFiles: []string{"go.mod", "Gopkg.toml", "glide.yaml"}, extensions: []string{".go"}},
+	{buildPack: "typescript", buildFiles: []string{"tsconfig.json"}, extensions: []string{".ts", ".tsx"}, implies: "javascript"},
+	{buildPack: "javascript", buildFiles: []string{"package.json"}, extensions: []string{".js", ".jsx"}},
+	{buildPack: "python", buildFiles: []string{"requirements.txt", "setup.py", "setup.cfg", "pyproject.toml", "Pipfile"}, extensions: []string{".py"}},
+}
+
+// skippedDirs are not searched for source files as they hold dependencies or tooling rather than the project
+var skippedDirs = []string{".git", "node_modules", "vendor", "target", "build", "dist"}
+
+// detectBuildPack guesses the build pack of the source tree in dir, or returns nil if nothing identifies one
+func detectBuildPack(dir string) *Detection {
+	var detection *Detection
+	implied := ""
+	for _, signature := range buildPackSignatures {
+		for _, file := range signature.buildFiles {
+			if !util.Exists(filepath.Join(dir, file)) {
+				continue
+			}
+			switch {
+			case detection == nil:
+				detection = &Detection{BuildPack: signature.buildPack, Confidence: ConfidenceHigh, Evidence: []string{file}}
+				implied = signature.implies
+			case detection.BuildPack == signature.buildPack || implied == signature.buildPack:
+				detection.Evidence = append(detection.Evidence, file)
+			default:
+				detection.Confidence = ConfidenceMedium
+				detection.Evidence = append(detection.Evidence, fmt.Sprintf("%s (%s)", file, signature.buildPack))
+			}
+		}
+	}
+	if detection != nil {
+		return detection
+	}
+
+	counts := map[string]int{}
+	countSourceFiles(dir, 0, counts)
+	best, bestCount := "", 0
+	for _, signature := range buildPackSignatures {
+		count := 0
+		for _, extension := range signature.extensions {
+			count += counts[extension]
+		}
+		if count > bestCount {
+			best, bestCount = signature.buildPack, count
+		}
+	}
+	if best == "" {
+		return nil
+	}
+	return &Detection{BuildPack: best, Confidence: ConfidenceLow, Evidence: []string{fmt.Sprintf("%d source files", bestCount)}}
+}
+
+// countSourceFiles counts the files below dir by extension
+func countSourceFiles(dir string, depth int, counts map[string]int) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			if depth < detectDepth && !util.Contains(skippedDirs, file.Name()) && !strings.HasPrefix(file.Name(), ".") {
+				countSourceFiles(filepath.Join(dir, file.Name()), depth+1, counts)
+			}
+			continue
+		}
+		counts[filepath.Ext(file.Name())]++
+	}
+}
+
+// resolveBuildPack returns the build pack of a pipeline, detecting it from the source tree when the
+// pipeline has none. The detection is made once per run as every context shares the source tree.
+func (e *Patcher) resolveBuildPack(config *ProjectConfig) BuildPack {
+	if config.BuildPack != "" && config.BuildPack != noBuildPack {
+		return e.buildPacks.lookup(config.BuildPack)
+	}
+	if !e.detected {
+		e.detected = true
+		e.detection = detectBuildPack(e.sourceDir)
+		if e.detection == nil {
+			logger.Warnf("No buildPack given and none detected from the source tree")
+		} else {
+			logger.Infof("No buildPack given, detected %s", e.detection)
+		}
+	}
+	if e.detection == nil {
+		return e.buildPacks.lookup(config.BuildPack)
+	}
+	buildPack := e.buildPacks.lookup(e.detection.BuildPack)
+	buildPack.detection = e.detection
+	return buildPack
+}
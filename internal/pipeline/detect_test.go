@@ -0,0 +1,49 @@
+package pipeline
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_detectBuildPack(t *testing.T) {
+	tests := []struct {
+		name string
+		dir  string
+		want *Detection
+	}{
+		{"build file", "../../test/go-detected", &Detection{BuildPack: "go", Confidence: ConfidenceHigh, Evidence: []string{"go.mod"}}},
+		{"implied build file", "../../test/detect/typescript", &Detection{BuildPack: "typescript", Confidence: ConfidenceHigh, Evidence: []string{"tsconfig.json", "package.json"}}},
+		{"several build packs", "../../test/detect/maven-frontend", &Detection{BuildPack: "maven", Confidence: ConfidenceMedium, Evidence: []string{"pom.xml", "package.json (javascript)"}}},
+		{"source files", "../../test/detect/python-sources", &Detection{BuildPack: "python", Confidence: ConfidenceLow, Evidence: []string{"3 source files"}}},
+		{"nothing", "../../test/detect/nothing", nil},
+		{"missing directory", "../../test/detect/absent", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, detectBuildPack(tt.dir))
+		})
+	}
+}
+
+func TestPatcher_resolveBuildPack(t *testing.T) {
+	registry, err := loadBuildPacks("")
+	assert.NoError(t, err)
+	e := &Patcher{sourceDir: "../../test/go-detected", buildPacks: registry}
+
+	buildPack := e.resolveBuildPack(&ProjectConfig{BuildPack: "maven"})
+	assert.Equal(t, "maven", buildPack.Name)
+	assert.Nil(t, buildPack.detection)
+
+	for _, name := range []string{"", "none"} {
+		buildPack = e.resolveBuildPack(&ProjectConfig{BuildPack: name})
+		assert.Equal(t, "go", buildPack.Name)
+		assert.Equal(t, "build-make-build", buildPack.anchors("release")[0].Step)
+		assert.Equal(t, ConfidenceHigh, buildPack.detection.Confidence)
+	}
+
+	e = &Patcher{sourceDir: "../../test/detect/nothing", buildPacks: registry}
+	buildPack = e.resolveBuildPack(&ProjectConfig{BuildPack: "none"})
+	assert.Equal(t, "none", buildPack.Name)
+	assert.Nil(t, buildPack.detection)
+}
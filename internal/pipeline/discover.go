@@ -0,0 +1,120 @@
+package pipeline
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// anchorRule recognises a step that builds or tests the project by its command
+type anchorRule struct {
+	name string
+	// buildPack is the build pack the command belongs to, when the command tells
+	buildPack string
+	pattern   *regexp.Regexp
+}
+
+// anchorRules are the commands after which a scan is placed when the anchor is discovered. Options may sit
+// between the tool and its goal, as in mvn -B clean install, but not a shell separator such as ;, &&, | or
+// a new line, which starts another command.
+var anchorRules = []anchorRule{
+	{name: "make test", pattern: commandPattern(`make`, `test`)},
+	{name: "mvn install", buildPack: "maven", pattern: commandPattern(`mvnw?`, `install`)},
+	{name: "gradle build", buildPack: "gradle", pattern: commandPattern(`gradlew?`, `build`)},
+	{name: "npm test", buildPack: "javascript", pattern: regexp.MustCompile(`\bnpm[ \t]+(run[ \t]+)?test` + commandEnd)},
+	{name: "pytest", buildPack: "python", pattern: regexp.MustCompile(`\bpytest` + commandEnd)},
+	{name: "sbt test", buildPack: "scala", pattern: commandPattern(`sbt`, `test`)},
+}
+
+// commandEnd ends the word a rule looks for, so that make test does not match make test-integration or
+// make test.log
+const commandEnd = `([\s;&|]|$)`
+
+// commandPattern matches a tool given a goal, possibly after other words of the same command
+func commandPattern(tool string, goal string) *regexp.Regexp {
+	return regexp.MustCompile(`\b` + tool + `[ \t]+([^;&|\s]+[ \t]+)*` + goal + commandEnd)
+}
+
+// discovery is an anchor found from the commands of the steps of a pipeline
+type discovery struct {
+	stage *Stage
+	// path is the path of the stage within the nested stages
+	path string
+	step *Step
+	rule anchorRule
+}
+
+// discoverAnchor looks for the last step of the first stage with steps whose command builds or tests the
+// project, or returns nil if it has none
+func discoverAnchor(targetPipeline *ParsedPipeline) *discovery {
+	var found *discovery
+	targetPipeline.WalkStages(func(stage *Stage, parents []*Stage) bool {
+		if !stage.HasSteps() {
+			return true
+		}
+		for _, step := range stage.Steps {
+			if rule, ok := matchAnchorRule(step); ok {
+				found = &discovery{stage: stage, path: stagePath(stage, parents), step: step, rule: rule}
+			}
+		}
+		return false
+	})
+	return found
+}
+
+// matchAnchorRule returns the first rule matching the command line of the step
+func matchAnchorRule(step *Step) (anchorRule, bool) {
+	commandLine := strings.Join(append([]string{step.Command}, append(step.Args, step.Sh)...), " ")
+	for _, rule := range anchorRules {
+		if rule.pattern.MatchString(commandLine) {
+			return rule, true
+		}
+	}
+	return anchorRule{}, false
+}
+
+// describe names the step found, which may have no name of its own
+func (d *discovery) describe() string {
+	if d.step.Name == "" {
+		return fmt.Sprintf("the step on line %d", d.step.Line())
+	}
+	return fmt.Sprintf("step '%s'", d.step.Name)
+}
+
+// insertDiscoveredScan inserts the scan after the step discovered in the pipeline, or leaves the pipeline
+// unscanned with a warning if there is none. A build pack neither given nor detected from the source tree is
+// taken from the command found, when it tells one.
+func (e *Patcher) insertDiscoveredScan(config *ProjectConfig, targetPipeline *ParsedPipeline, buildPack BuildPack, name string, properties map[string]string, decision *Decision) error {
+	found := discoverAnchor(targetPipeline)
+	if found == nil {
+		rules := []string{}
+		for _, rule := range anchorRules {
+			rules = append(rules, rule.name)
+		}
+		decision.Reason = fmt.Sprintf("no anchor for buildPack '%s' and none discovered", buildPack.Name)
+		logger.WithFields(log.Fields{"sonarscananchor": "missing", "pipeline": decision.Pipeline, "buildPack": buildPack.Name}).
+			Warnf("Skipping scan on %s pipeline: %s. No step of the first stage runs %s. Set the anchor in %s or in the build pack registry.", decision.Pipeline, decision.Reason, strings.Join(rules, ", "), userOverridesFile)
+		return nil
+	}
+	logger.WithFields(log.Fields{"sonarscananchor": "discovered", "pipeline": decision.Pipeline, "rule": found.rule.name}).
+		Infof("Anchoring the scan of %s pipeline after %s of stage '%s' as it runs %s", decision.Pipeline, found.describe(), found.path, found.rule.name)
+	decision.describeAnchor(BuildStep{Stage: found.path, Step: found.step.Name, Position: PositionAfter}, found.stage, found.step)
+	decision.Discovered = found.rule.name
+	decision.Reason = ""
+	if buildPack.Name == "" || buildPack.Name == noBuildPack {
+		if found.rule.buildPack != "" {
+			buildPack = e.buildPacks.lookup(found.rule.buildPack)
+		} else {
+			logger.Warnf("No buildPack given, detected from the source tree or told by %s, the scan of %s pipeline relies on the sonar-project.properties of the project", found.rule.name, decision.Pipeline)
+		}
+	}
+	found.stage.InsertStep(found.stage.IndexOfStep(found.step)+1, e.createApplicationStep(name, properties, buildPack.template()))
+	decision.Action = ActionInsert
+
+	if buildPack.Name == "" {
+		return nil
+	}
+	return e.addBuildPackName(config, targetPipeline, buildPack.Name)
+}
@@ -0,0 +1,64 @@
+package pipeline
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_matchAnchorRule(t *testing.T) {
+	tests := []struct {
+		name string
+		step *Step
+		want string
+	}{
+		{"make test", &Step{Command: "make test"}, "make test"},
+		{"make with targets", &Step{Command: "make", Args: []string{"lint", "test"}}, "make test"},
+		{"make build", &Step{Command: "make build"}, ""},
+		{"maven options", &Step{Command: "mvn", Args: []string{"-B", "clean", "install"}}, "mvn install"},
+		{"maven wrapper", &Step{Command: "./mvnw clean install"}, "mvn install"},
+		{"maven deploy", &Step{Command: "mvn -B deploy"}, ""},
+		{"gradle wrapper", &Step{Command: "./gradlew clean build"}, "gradle build"},
+		{"npm run test", &Step{Command: "npm", Args: []string{"run", "test"}}, "npm test"},
+		{"npm install", &Step{Command: "npm install"}, ""},
+		{"pytest in a script", &Step{Sh: "pip install -r requirements.txt && pytest tests/"}, "pytest"},
+		{"sbt", &Step{Command: "sbt clean test"}, "sbt test"},
+		{"make after another command", &Step{Command: "make build && echo test"}, ""},
+		{"maven after another command", &Step{Command: "mvn compile; echo install"}, ""},
+		{"make piped", &Step{Sh: "make build | tee test"}, ""},
+		{"make on another line", &Step{Sh: "make build\necho test"}, ""},
+		{"make test after another command", &Step{Sh: "go vet ./... && make test"}, "make test"},
+		{"make test and other targets", &Step{Command: "make test-integration test lint"}, "make test"},
+		{"make test followed by a separator", &Step{Sh: "make test;echo done"}, "make test"},
+		{"make goal starting with test", &Step{Command: "make test-integration"}, ""},
+		{"make file starting with test", &Step{Sh: "make build > test.log"}, ""},
+		{"make goal with a suffix", &Step{Command: "make test.log"}, ""},
+		{"npm script starting with test", &Step{Command: "npm run test:e2e"}, ""},
+		{"pytest plugin", &Step{Sh: "pip install pytest-cov"}, ""},
+		{"sbt goal starting with test", &Step{Command: "sbt testOnly"}, ""},
+		{"nothing", &Step{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, ok := matchAnchorRule(tt.step)
+			assert.Equal(t, tt.want != "", ok)
+			assert.Equal(t, tt.want, rule.name)
+		})
+	}
+}
+
+func Test_discoverAnchor(t *testing.T) {
+	config, err := LoadProjectConfig("../../test/custom-discover/jenkins-x-effective.yml")
+	assert.NoError(t, err)
+
+	// The last matching step of the first stage, pytest in a later stage is not considered
+	found := discoverAnchor(config.Pipeline("pullRequest"))
+	assert.NotNil(t, found)
+	assert.Equal(t, "ci", found.path)
+	assert.Equal(t, "unit-tests", found.step.Name)
+	assert.Equal(t, "mvn install", found.rule.name)
+	assert.Equal(t, "maven", found.rule.buildPack)
+	assert.Equal(t, "step 'unit-tests'", found.describe())
+
+	assert.Nil(t, discoverAnchor(config.Pipeline("release")))
+}
@@ -0,0 +1,347 @@
+package pipeline
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v3"
+)
+
+const (
+	// indentWidth is the number of spaces used for each level of nesting
+	indentWidth = 2
+	// bestWidth is the column after which long plain scalars are folded
+	bestWidth = 80
+)
+
+// encoder serialises a yaml.v3 node tree in the block style jx uses when it writes
+// jenkins-x-effective.yml: two space indents, sequences that are not indented below
+// their parent key and plain scalars folded once they pass the 80th column.
+type encoder struct {
+	buf    bytes.Buffer
+	column int
+	// source holds the lines the node was parsed from, to keep the blank lines between entries
+	source []string
+}
+
+// encodeNode serialises the given node, normally a document node, to YAML. The blank lines that separate
+// entries in source, the content the node was parsed from, are kept.
+func encodeNode(node *yaml.Node, source []byte) ([]byte, error) {
+	e := &encoder{source: strings.Split(string(source), "\n")}
+	if node.Kind == yaml.DocumentNode {
+		e.comment(node.HeadComment, 0)
+		if node.HeadComment != "" {
+			e.newline()
+		}
+		for _, child := range node.Content {
+			if err := e.block(child, 0); err != nil {
+				return nil, err
+			}
+		}
+		if node.FootComment != "" {
+			e.newline()
+			e.comment(node.FootComment, 0)
+		}
+	} else if err := e.block(node, 0); err != nil {
+		return nil, err
+	}
+	return e.buf.Bytes(), nil
+}
+
+// block writes a top level node at the given indent
+func (e *encoder) block(node *yaml.Node, indent int) error {
+	switch {
+	case isBlockMapping(node):
+		e.blockAnchor(node, indent)
+		return e.mapping(node, indent, false)
+	case isBlockSequence(node):
+		e.blockAnchor(node, indent)
+		return e.sequence(node, indent, false)
+	default:
+		e.indent(indent)
+		if err := e.flow(node, indent); err != nil {
+			return err
+		}
+		e.lineComment(node.LineComment)
+		e.newline()
+		return nil
+	}
+}
+
+// mapping writes a block mapping, inline indicates that the first key continues the current line
+func (e *encoder) mapping(node *yaml.Node, indent int, inline bool) error {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if !inline || i > 0 {
+			e.blankLines(key, key.HeadComment)
+			e.comment(key.HeadComment, indent)
+			e.indent(indent)
+		}
+		k, err := renderScalar(key)
+		if err != nil {
+			return errors.Wrapf(err, "rendering key at line %d", key.Line)
+		}
+		e.write(k + ":")
+		switch {
+		case isBlockMapping(value):
+			e.anchor(value)
+			e.lineComment(key.LineComment)
+			e.lineComment(value.LineComment)
+			e.newline()
+			e.comment(value.HeadComment, indent+indentWidth)
+			if err := e.mapping(value, indent+indentWidth, false); err != nil {
+				return err
+			}
+		case isBlockSequence(value):
+			e.anchor(value)
+			e.lineComment(key.LineComment)
+			e.lineComment(value.LineComment)
+			e.newline()
+			if err := e.sequence(value, indent, false); err != nil {
+				return err
+			}
+		default:
+			if !isEmptyNull(value) {
+				e.write(" ")
+			}
+			if err := e.flow(value, indent+indentWidth); err != nil {
+				return err
+			}
+			e.lineComment(key.LineComment)
+			e.lineComment(value.LineComment)
+			e.newline()
+		}
+		e.comment(value.FootComment, indent)
+		e.comment(key.FootComment, indent)
+	}
+	return nil
+}
+
+// sequence writes a block sequence, inline indicates that the first item continues the current line
+func (e *encoder) sequence(node *yaml.Node, indent int, inline bool) error {
+	for i, item := range node.Content {
+		// An anchored collection starts on the line after its anchor rather than after the dash
+		anchored := (isBlockMapping(item) || isBlockSequence(item)) && item.Anchor != ""
+		if !inline || i > 0 {
+			if isBlockMapping(item) && !anchored {
+				e.blankLines(item, item.HeadComment, item.Content[0].HeadComment)
+				e.comment(item.HeadComment, indent)
+				e.comment(item.Content[0].HeadComment, indent)
+			} else {
+				e.blankLines(item, item.HeadComment)
+				e.comment(item.HeadComment, indent)
+			}
+			e.indent(indent)
+		}
+		e.write("- ")
+		switch {
+		case anchored:
+			e.write("&" + item.Anchor)
+			e.newline()
+			if isBlockMapping(item) {
+				if err := e.mapping(item, indent+indentWidth, false); err != nil {
+					return err
+				}
+			} else if err := e.sequence(item, indent+indentWidth, false); err != nil {
+				return err
+			}
+		case isBlockMapping(item):
+			if err := e.mapping(item, indent+indentWidth, true); err != nil {
+				return err
+			}
+		case isBlockSequence(item):
+			if err := e.sequence(item, indent+indentWidth, true); err != nil {
+				return err
+			}
+		default:
+			if err := e.flow(item, indent+indentWidth); err != nil {
+				return err
+			}
+			e.lineComment(item.LineComment)
+			e.newline()
+		}
+		e.comment(item.FootComment, indent)
+	}
+	return nil
+}
+
+// flow writes a node that fits on the current line, folding long plain scalars at the given indent
+func (e *encoder) flow(node *yaml.Node, indent int) error {
+	if node.Anchor != "" {
+		e.write("&" + node.Anchor + " ")
+	}
+	if node.Kind == yaml.AliasNode {
+		e.write("*" + node.Value)
+		return nil
+	}
+	if isEmptyNull(node) {
+		return nil
+	}
+	if node.Kind == yaml.ScalarNode && node.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+		e.literal(node.Value, indent)
+		return nil
+	}
+	s, err := renderScalar(node)
+	if err != nil {
+		return errors.Wrapf(err, "rendering value at line %d", node.Line)
+	}
+	switch {
+	case node.Kind != yaml.ScalarNode:
+		e.write(s)
+	case strings.HasPrefix(s, "|") || strings.HasPrefix(s, ">"):
+		e.literal(node.Value, indent)
+	case strings.HasPrefix(s, `"`) || strings.HasPrefix(s, "'"):
+		e.write(s)
+	default:
+		e.plain(s, indent)
+	}
+	return nil
+}
+
+// plain writes a plain scalar, breaking on a space once the line is longer than bestWidth
+func (e *encoder) plain(s string, indent int) {
+	runes := []rune(s)
+	spaces := false
+	for i, r := range runes {
+		if r == ' ' {
+			if !spaces && e.column > bestWidth && i+1 < len(runes) && runes[i+1] != ' ' {
+				e.newline()
+				e.indent(indent)
+			} else {
+				e.write(" ")
+			}
+			spaces = true
+			continue
+		}
+		e.write(string(r))
+		spaces = false
+	}
+}
+
+// literal writes a multi-line string as a literal block scalar
+func (e *encoder) literal(s string, indent int) {
+	header := "|"
+	if strings.HasPrefix(s, " ") || strings.HasPrefix(s, "\n") {
+		header += "2"
+	}
+	switch {
+	case !strings.HasSuffix(s, "\n"):
+		header += "-"
+	case strings.HasSuffix(s, "\n\n"):
+		header += "+"
+	}
+	e.write(header)
+	for _, line := range strings.Split(strings.TrimSuffix(s, "\n"), "\n") {
+		e.newline()
+		if line != "" {
+			e.indent(indent)
+			e.write(line)
+		}
+	}
+}
+
+// comment writes each line of a head or foot comment at the given indent
+func (e *encoder) comment(comment string, indent int) {
+	if comment == "" {
+		return
+	}
+	for _, line := range strings.Split(comment, "\n") {
+		if line != "" {
+			e.indent(indent)
+			e.write(line)
+		}
+		e.newline()
+	}
+}
+
+// blankLines writes the blank lines that preceded the node, and the comments above it, in the source.
+// Lines already ended by a kept block scalar are not written twice.
+func (e *encoder) blankLines(node *yaml.Node, comments ...string) {
+	if node.Line == 0 || e.buf.Len() == 0 {
+		return
+	}
+	start := node.Line
+	for _, comment := range comments {
+		if comment != "" {
+			start -= strings.Count(comment, "\n") + 1
+		}
+	}
+	blank := 0
+	for line := start - 1; line >= 1 && line <= len(e.source) && strings.TrimSpace(e.source[line-1]) == ""; line-- {
+		blank++
+	}
+	written := len(e.buf.Bytes()) - len(bytes.TrimRight(e.buf.Bytes(), "\n")) - 1
+	for ; written < blank; written++ {
+		e.newline()
+	}
+}
+
+// anchor appends the anchor of a block collection to the line of its key
+func (e *encoder) anchor(node *yaml.Node) {
+	if node.Anchor != "" {
+		e.write(" &" + node.Anchor)
+	}
+}
+
+// blockAnchor writes the anchor of a top level block collection on a line of its own
+func (e *encoder) blockAnchor(node *yaml.Node, indent int) {
+	if node.Anchor != "" {
+		e.indent(indent)
+		e.write("&" + node.Anchor)
+		e.newline()
+	}
+}
+
+// lineComment appends a comment to the current line
+func (e *encoder) lineComment(comment string) {
+	if comment != "" {
+		e.write(" " + comment)
+	}
+}
+
+func (e *encoder) indent(n int) {
+	e.write(nspaces(n))
+}
+
+func (e *encoder) newline() {
+	e.buf.WriteString("\n")
+	e.column = 0
+}
+
+func (e *encoder) write(s string) {
+	e.buf.WriteString(s)
+	e.column += len([]rune(s))
+}
+
+// renderScalar lets yaml.v3 decide how a scalar, or a collection in flow style, must be quoted
+func renderScalar(node *yaml.Node) (string, error) {
+	n := *node
+	n.Anchor = ""
+	n.HeadComment = ""
+	n.LineComment = ""
+	n.FootComment = ""
+	if n.Kind == yaml.MappingNode || n.Kind == yaml.SequenceNode {
+		n.Style |= yaml.FlowStyle
+	}
+	out, err := yaml.Marshal(&n)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+// isBlockMapping indicates whether the node is a non-empty mapping written in block style
+func isBlockMapping(node *yaml.Node) bool {
+	return node.Kind == yaml.MappingNode && node.Style&yaml.FlowStyle == 0 && len(node.Content) > 0
+}
+
+// isBlockSequence indicates whether the node is a non-empty sequence written in block style
+func isBlockSequence(node *yaml.Node) bool {
+	return node.Kind == yaml.SequenceNode && node.Style&yaml.FlowStyle == 0 && len(node.Content) > 0
+}
+
+// isEmptyNull indicates whether the node is a null value that was written without any text
+func isEmptyNull(node *yaml.Node) bool {
+	return node.Kind == yaml.ScalarNode && node.Tag == "!!null" && node.Value == ""
+}
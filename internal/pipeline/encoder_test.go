@@ -0,0 +1,59 @@
+package pipeline
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	yaml "gopkg.in/yaml.v3"
+)
+
+func Test_encodeNode_roundTrip(t *testing.T) {
+	files, err := filepath.Glob("../../test/*/jenkins-x-effective*.yml")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, files)
+	for _, file := range files {
+		t.Run(file, func(t *testing.T) {
+			content, err := ioutil.ReadFile(file)
+			assert.NoError(t, err)
+			var doc yaml.Node
+			assert.NoError(t, yaml.Unmarshal(content, &doc))
+			got, err := encodeNode(&doc, content)
+			assert.NoError(t, err)
+			got = append(got, trailingBlankLines(content, &doc)...)
+			assert.Equal(t, string(content), string(got))
+		})
+	}
+}
+
+func Test_encodeNode(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"nested sequences", "a:\n- - b\n  - c\n- d\n"},
+		{"empty values", "a:\nb: {}\nc: []\nd: \"\"\n"},
+		{"literal keep", "sh: |\n  echo a\n\n  echo b\n"},
+		{"literal strip", "sh: |-\n  echo a\n  echo b\n"},
+		{"flow collections", "a: {b: c, d: [e, f]}\n"},
+		{"comments", "# head\na: b # line\n# foot\nc: d\n"},
+		{"anchors", "a: &x b\nc: *x\n"},
+		{"blank lines", "a: b\n\nc:\n  d: e\n\n\n  f: g\nh:\n- i\n\n- j: k\n  l: m\n"},
+		{"blank line before comment", "a: b\n\n# head\nc: d\n"},
+		{"blank line after foot comment", "a: b\n# foot\n\nc: d\n"},
+		{"anchored mapping", "a: &x\n  b: c\nd: *x\n"},
+		{"anchored sequence", "a: &x\n- b\nc: *x\n"},
+		{"anchored sequence item", "a:\n- &x\n  b: c\n- *x\n"},
+		{"kept literal before key", "a: |+\n  b\n\nc: d\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var doc yaml.Node
+			assert.NoError(t, yaml.Unmarshal([]byte(tt.in), &doc))
+			got, err := encodeNode(&doc, []byte(tt.in))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.in, string(got))
+		})
+	}
+}
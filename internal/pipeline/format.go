@@ -0,0 +1,129 @@
+package pipeline
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v3"
+)
+
+const (
+	// UserOverridesAPIVersion is the latest version of the user overrides file format
+	UserOverridesAPIVersion = "jx-app-sonar-scanner.jenkins-x.io/v1"
+
+	// UserOverridesKind is the kind of document held by a user overrides file
+	UserOverridesKind = "SonarScannerConfig"
+)
+
+// documentSchema describes a versioned file holding the settings described by spec under spec
+func documentSchema(spec *schema) *schema {
+	return &schema{
+		Type:        schemaTypeObject,
+		Description: spec.Description,
+		Required:    []string{"apiVersion", "kind"},
+		Properties: map[string]*schema{
+			"apiVersion": {
+				Type:        schemaTypeString,
+				Description: "The version of the file format.",
+				Enum:        []string{UserOverridesAPIVersion},
+			},
+			"kind": {
+				Type:        schemaTypeString,
+				Description: "The kind of document.",
+				Enum:        []string{UserOverridesKind},
+			},
+			"spec": {
+				Type:        schemaTypeObject,
+				Description: "The settings.",
+				Properties:  spec.Properties,
+				Excluded:    spec.Excluded,
+			},
+		},
+	}
+}
+
+// isLegacy reports whether the top level node of a user overrides file is in the unversioned format,
+// which holds its settings at the top level
+func isLegacy(root *yaml.Node) bool {
+	return mappingValue(root, "apiVersion") == nil
+}
+
+// specNode returns the settings of a user overrides file, whatever its format. It is nil for an empty file.
+func specNode(root *yaml.Node) *yaml.Node {
+	if root == nil || root.Kind != yaml.MappingNode {
+		return nil
+	}
+	if isLegacy(root) {
+		return root
+	}
+	spec := mappingValue(root, "spec")
+	if spec == nil || spec.Kind != yaml.MappingNode {
+		return nil
+	}
+	return spec
+}
+
+// MigrateUserOverrides rewrites a user overrides file in the latest format, keeping its comments. It
+// returns the content unchanged, and false, when the file is already in the latest format.
+func MigrateUserOverrides(content []byte) ([]byte, bool, error) {
+	problems := ValidateUserOverrides(content)
+	if len(problems) > 0 {
+		return nil, false, problemsError(problems)
+	}
+	doc := &yaml.Node{}
+	err := yaml.Unmarshal(content, doc)
+	if err != nil {
+		return nil, false, err
+	}
+	root := rootNode(doc)
+	if root != nil && !isLegacy(root) {
+		return content, false, nil
+	}
+
+	spec := newMappingNode()
+	headComment := doc.HeadComment
+	if root != nil && root.Kind == yaml.MappingNode {
+		spec = root
+		// A comment at the top of the file describes the file rather than its first setting
+		headComment = joinComments(headComment, root.HeadComment)
+		root.HeadComment = ""
+		if len(spec.Content) > 0 {
+			headComment = joinComments(headComment, spec.Content[0].HeadComment)
+			spec.Content[0].HeadComment = ""
+		}
+	}
+	spec.Style = 0
+	migrated := newMappingNode(
+		newStringNode("apiVersion"), newStringNode(UserOverridesAPIVersion),
+		newStringNode("kind"), newStringNode(UserOverridesKind),
+		newStringNode("spec"), spec,
+	)
+	migrated.HeadComment = headComment
+
+	out := &bytes.Buffer{}
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte("---")) {
+		out.WriteString("---\n")
+	}
+	encoder := yaml.NewEncoder(out)
+	encoder.SetIndent(4)
+	err = encoder.Encode(migrated)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "unable to write migrated configuration")
+	}
+	err = encoder.Close()
+	if err != nil {
+		return nil, false, errors.Wrap(err, "unable to write migrated configuration")
+	}
+	return out.Bytes(), true, nil
+}
+
+// joinComments joins two comments, either of which may be empty
+func joinComments(a string, b string) string {
+	if a == "" {
+		return b
+	}
+	if b == "" {
+		return a
+	}
+	return a + "\n" + b
+}
@@ -0,0 +1,59 @@
+package pipeline
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrateUserOverrides(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		want        string
+		wantChanged bool
+		wantErr     bool
+	}{
+		{
+			name:        "legacy",
+			content:     "---\n# Scanner settings\nverbose: true # for now\npullRequest:\n    # after the tests\n    stage: build\n    step: make-test\n",
+			want:        "---\n# Scanner settings\napiVersion: jx-app-sonar-scanner.jenkins-x.io/v1\nkind: SonarScannerConfig\nspec:\n    verbose: true # for now\n    pullRequest:\n        # after the tests\n        stage: build\n        step: make-test\n",
+			wantChanged: true,
+		},
+		{
+			name:        "empty",
+			content:     "",
+			want:        "apiVersion: jx-app-sonar-scanner.jenkins-x.io/v1\nkind: SonarScannerConfig\nspec: {}\n",
+			wantChanged: true,
+		},
+		{
+			name:    "latest",
+			content: "apiVersion: jx-app-sonar-scanner.jenkins-x.io/v1\nkind: SonarScannerConfig\nspec:\n  skip: true\n",
+			want:    "apiVersion: jx-app-sonar-scanner.jenkins-x.io/v1\nkind: SonarScannerConfig\nspec:\n  skip: true\n",
+		},
+		{
+			name:    "invalid",
+			content: "verbsoe: true\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, changed, err := MigrateUserOverrides([]byte(tt.content))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, string(got))
+			assert.Equal(t, tt.wantChanged, changed)
+			assert.Empty(t, ValidateUserOverrides(got))
+
+			migrated, err := parseUserOverrides(got)
+			assert.NoError(t, err)
+			legacy, err := parseUserOverrides([]byte(tt.content))
+			assert.NoError(t, err)
+			assert.Equal(t, legacy, migrated)
+		})
+	}
+}
@@ -0,0 +1,555 @@
+package pipeline
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// ProjectConfig is a typed view of an effective pipeline such as jenkins-x-effective.yml.
+// Every type in the model keeps the YAML node it was loaded from, so anything the model
+// does not know about is written back unchanged when the config is saved.
+type ProjectConfig struct {
+	BuildPack      string
+	PipelineConfig *PipelineConfig
+
+	doc     *yaml.Node
+	source  []byte
+	trailer []byte
+}
+
+// PipelineConfig models the pipelineConfig: section of the effective pipeline.
+type PipelineConfig struct {
+	Env       *EnvVars
+	Pipelines *Pipelines
+
+	node *yaml.Node
+}
+
+// Pipelines models pipelineConfig.pipelines, one entry per pipeline kind.
+type Pipelines struct {
+	PullRequest *PipelineLifecycles
+	Release     *PipelineLifecycles
+	Feature     *PipelineLifecycles
+
+	node *yaml.Node
+}
+
+// PipelineLifecycles models a single pipeline kind such as pullRequest or release.
+type PipelineLifecycles struct {
+	Pipeline *ParsedPipeline
+
+	node *yaml.Node
+}
+
+// ParsedPipeline models the pipeline: of a pipeline kind.
+type ParsedPipeline struct {
+	Env     *EnvVars
+	Options *RootOptions
+	Stages  []*Stage
+
+	node       *yaml.Node
+	stagesNode *yaml.Node
+}
+
+// RootOptions models the options: of a pipeline.
+type RootOptions struct {
+	ContainerOptions *ContainerOptions
+
+	node *yaml.Node
+}
+
+// ContainerOptions models options.containerOptions of a pipeline.
+type ContainerOptions struct {
+	Env *EnvVars
+
+	node *yaml.Node
+}
+
+// Stage models a stage, which holds either steps or nested stages run in sequence or in parallel.
+type Stage struct {
+	Name     string
+	Steps    []*Step
+	Stages   []*Stage
+	Parallel []*Stage
+
+	node         *yaml.Node
+	stepsNode    *yaml.Node
+	stagesNode   *yaml.Node
+	parallelNode *yaml.Node
+}
+
+// Step models a single step of a stage.
+type Step struct {
+	Name    string
+	Command string
+	Args    []string
+	Image   string
+	Sh      string
+
+	node *yaml.Node
+}
+
+// EnvVars models an env: list.
+type EnvVars struct {
+	Vars []*EnvVar
+
+	node *yaml.Node
+}
+
+// EnvVar models a single entry of an env: list.
+type EnvVar struct {
+	Name  string
+	Value string
+
+	node *yaml.Node
+}
+
+// LoadProjectConfig reads the effective pipeline stored at path.
+func LoadProjectConfig(path string) (*ProjectConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to open pipeline config '%s'", path)
+	}
+	config, err := ParseProjectConfig(content)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse pipeline config '%s'", path)
+	}
+	return config, nil
+}
+
+// ParseProjectConfig builds the model for the given effective pipeline content.
+func ParseProjectConfig(content []byte) (*ProjectConfig, error) {
+	if len(bytes.TrimSpace(content)) == 0 {
+		return nil, errors.Errorf("empty pipeline")
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, err
+	}
+	root := rootNode(&doc)
+	if root == nil || root.Kind != yaml.MappingNode {
+		return nil, errors.Errorf("pipeline config is not a mapping")
+	}
+	return &ProjectConfig{
+		BuildPack:      getBuildPack(root),
+		PipelineConfig: newPipelineConfig(mappingValue(root, "pipelineConfig")),
+		doc:            &doc,
+		source:         content,
+		trailer:        trailingBlankLines(content, &doc),
+	}, nil
+}
+
+// Bytes serialises the effective pipeline, including any changes made through the model.
+func (c *ProjectConfig) Bytes() ([]byte, error) {
+	content, err := encodeNode(c.doc, c.source)
+	if err != nil {
+		return nil, err
+	}
+	return append(content, c.trailer...), nil
+}
+
+// Save writes the effective pipeline to path.
+func (c *ProjectConfig) Save(path string) error {
+	content, err := c.Bytes()
+	if err != nil {
+		return errors.Wrap(err, "unable to serialise pipeline config")
+	}
+	return ioutil.WriteFile(path, content, 0644)
+}
+
+// Pipeline returns the pipeline of the given kind (pullRequest, release or feature), or nil if there is none.
+func (c *ProjectConfig) Pipeline(kind string) *ParsedPipeline {
+	if c.PipelineConfig == nil || c.PipelineConfig.Pipelines == nil {
+		return nil
+	}
+	var lifecycles *PipelineLifecycles
+	switch kind {
+	case "pullRequest":
+		lifecycles = c.PipelineConfig.Pipelines.PullRequest
+	case "release":
+		lifecycles = c.PipelineConfig.Pipelines.Release
+	case "feature":
+		lifecycles = c.PipelineConfig.Pipelines.Feature
+	}
+	if lifecycles == nil {
+		return nil
+	}
+	return lifecycles.Pipeline
+}
+
+// EnsureEnv returns the env: list of pipelineConfig, creating it as the first entry if needed. An env:
+// key without a list, such as env: or env: {}, is given the list rather than repeated. Any other value is
+// an error.
+func (c *PipelineConfig) EnsureEnv() (*EnvVars, error) {
+	if c.Env == nil {
+		env := newSequenceNode()
+		existing := mappingValue(c.node, "env")
+		switch {
+		case existing == nil:
+			insertNodes(c.node, 0, newStringNode("env"), env)
+		case existing.Kind == yaml.ScalarNode || (existing.Kind == yaml.MappingNode && len(existing.Content) == 0):
+			env.LineComment = existing.LineComment
+			setMappingValue(c.node, "env", env)
+		default:
+			return nil, errors.Errorf("unable to add to env: of pipelineConfig on line %d, expected a list", existing.Line)
+		}
+		c.Env = newEnvVars(env)
+	}
+	return c.Env, nil
+}
+
+// EnvVars returns the env: list of the pipeline itself or, failing that, of its container options.
+func (p *ParsedPipeline) EnvVars() *EnvVars {
+	if p.Env != nil {
+		return p.Env
+	}
+	if p.Options != nil && p.Options.ContainerOptions != nil {
+		return p.Options.ContainerOptions.Env
+	}
+	return nil
+}
+
+// HasStages indicates whether the pipeline declares a stages: list.
+func (p *ParsedPipeline) HasStages() bool {
+	return p.stagesNode != nil
+}
+
+// WalkStages visits every stage of the pipeline depth first, including nested and parallel stages.
+// The walk stops as soon as fn returns false.
+func (p *ParsedPipeline) WalkStages(fn func(stage *Stage, parents []*Stage) bool) {
+	walkStages(p.Stages, nil, fn)
+}
+
+func walkStages(stages []*Stage, parents []*Stage, fn func(stage *Stage, parents []*Stage) bool) bool {
+	for _, stage := range stages {
+		if !fn(stage, parents) {
+			return false
+		}
+		path := append(append([]*Stage{}, parents...), stage)
+		if !walkStages(stage.Stages, path, fn) || !walkStages(stage.Parallel, path, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// InsertStageAfter inserts stage directly after anchor, in whichever stages: or parallel: list holds anchor.
+func (p *ParsedPipeline) InsertStageAfter(anchor *Stage, stage *Stage) error {
+	if insertStageAfter(&p.Stages, p.stagesNode, anchor, stage) {
+		return nil
+	}
+	return errors.Errorf("stage '%s' is not part of the pipeline", anchor.Name)
+}
+
+func insertStageAfter(stages *[]*Stage, node *yaml.Node, anchor *Stage, stage *Stage) bool {
+	for i, candidate := range *stages {
+		if candidate == anchor {
+			insertNodes(node, indexOfNode(node, anchor.node)+1, stage.node)
+			updated := make([]*Stage, 0, len(*stages)+1)
+			updated = append(updated, (*stages)[:i+1]...)
+			updated = append(updated, stage)
+			*stages = append(updated, (*stages)[i+1:]...)
+			return true
+		}
+		if insertStageAfter(&candidate.Stages, candidate.stagesNode, anchor, stage) ||
+			insertStageAfter(&candidate.Parallel, candidate.parallelNode, anchor, stage) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewStage creates a stage that runs the given steps.
+func NewStage(name string, steps ...*Step) *Stage {
+	stepsNode := newSequenceNode()
+	for _, step := range steps {
+		stepsNode.Content = append(stepsNode.Content, step.node)
+	}
+	return &Stage{
+		Name:      name,
+		Steps:     steps,
+		node:      newMappingNode(newStringNode("name"), newStringNode(name), newStringNode("steps"), stepsNode),
+		stepsNode: stepsNode,
+	}
+}
+
+// Line returns the line on which the stage starts.
+func (s *Stage) Line() int {
+	return s.node.Line
+}
+
+// HasSteps indicates whether the stage declares a steps: list.
+func (s *Stage) HasSteps() bool {
+	return s.stepsNode != nil
+}
+
+// IndexOfStep returns the position of step within the stage, or -1 if it is not part of it.
+func (s *Stage) IndexOfStep(step *Step) int {
+	for i, candidate := range s.Steps {
+		if candidate == step {
+			return i
+		}
+	}
+	return -1
+}
+
+// InsertStep inserts step into the stage at the given position.
+func (s *Stage) InsertStep(index int, step *Step) {
+	if s.stepsNode == nil {
+		s.stepsNode = newSequenceNode()
+		s.node.Content = append(s.node.Content, newStringNode("steps"), s.stepsNode)
+	}
+	position := len(s.stepsNode.Content)
+	if index < len(s.Steps) {
+		position = indexOfNode(s.stepsNode, s.Steps[index].node)
+	}
+	insertNodes(s.stepsNode, position, step.node)
+	steps := make([]*Step, 0, len(s.Steps)+1)
+	steps = append(steps, s.Steps[:index]...)
+	steps = append(steps, step)
+	s.Steps = append(steps, s.Steps[index:]...)
+}
+
+// NewStep creates a step that runs command with args in the given image.
+func NewStep(name string, command string, args []string, image string) *Step {
+	argNodes := newSequenceNode()
+	for _, arg := range args {
+		argNodes.Content = append(argNodes.Content, newStringNode(arg))
+	}
+	return &Step{
+		Name:    name,
+		Command: command,
+		Args:    args,
+		Image:   image,
+		node: newMappingNode(
+			newStringNode("command"), newStringNode(command),
+			newStringNode("args"), argNodes,
+			newStringNode("image"), newStringNode(image),
+			newStringNode("name"), newStringNode(name),
+		),
+	}
+}
+
+// Line returns the line on which the step starts.
+func (s *Step) Line() int {
+	return s.node.Line
+}
+
+// SetArgs replaces the arguments of the step.
+func (s *Step) SetArgs(args []string) {
+	argNodes := newSequenceNode()
+	for _, arg := range args {
+		argNodes.Content = append(argNodes.Content, newStringNode(arg))
+	}
+	if mappingValue(s.node, "args") == nil {
+		// Keep args next to the command they belong to, as NewStep does
+		if command := mappingValue(s.node, "command"); command != nil {
+			insertNodes(s.node, indexOfNode(s.node, command)+1, newStringNode("args"), argNodes)
+			s.Args = args
+			return
+		}
+	}
+	setMappingValue(s.node, "args", argNodes)
+	s.Args = args
+}
+
+// SetImage replaces the image in which the step runs.
+func (s *Step) SetImage(image string) {
+	setMappingValue(s.node, "image", newStringNode(image))
+	s.Image = image
+}
+
+// Line returns the line on which the env: list starts.
+func (e *EnvVars) Line() int {
+	return e.node.Line
+}
+
+// Get returns the variable with the given name, or nil if it is not set.
+func (e *EnvVars) Get(name string) *EnvVar {
+	for _, v := range e.Vars {
+		if v.Name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+// Line returns the line on which the variable starts.
+func (v *EnvVar) Line() int {
+	return v.node.Line
+}
+
+// Insert adds a variable to the list at the given position.
+func (e *EnvVars) Insert(index int, name string, value string) *EnvVar {
+	v := &EnvVar{
+		Name:  name,
+		Value: value,
+		node: newMappingNode(
+			newStringNode("name"), newStringNode(name),
+			newStringNode("value"), newStringNode(value),
+		),
+	}
+	insertNodes(e.node, index, v.node)
+	vars := make([]*EnvVar, 0, len(e.Vars)+1)
+	vars = append(vars, e.Vars[:index]...)
+	vars = append(vars, v)
+	e.Vars = append(vars, e.Vars[index:]...)
+	return v
+}
+
+func newPipelineConfig(node *yaml.Node) *PipelineConfig {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	return &PipelineConfig{
+		Env:       newEnvVars(mappingValue(node, "env")),
+		Pipelines: newPipelines(mappingValue(node, "pipelines")),
+		node:      node,
+	}
+}
+
+func newPipelines(node *yaml.Node) *Pipelines {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	return &Pipelines{
+		PullRequest: newPipelineLifecycles(mappingValue(node, "pullRequest")),
+		Release:     newPipelineLifecycles(mappingValue(node, "release")),
+		Feature:     newPipelineLifecycles(mappingValue(node, "feature")),
+		node:        node,
+	}
+}
+
+func newPipelineLifecycles(node *yaml.Node) *PipelineLifecycles {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	return &PipelineLifecycles{
+		Pipeline: newParsedPipeline(mappingValue(node, "pipeline")),
+		node:     node,
+	}
+}
+
+func newParsedPipeline(node *yaml.Node) *ParsedPipeline {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	stagesNode := sequenceValue(node, "stages")
+	return &ParsedPipeline{
+		Env:        newEnvVars(mappingValue(node, "env")),
+		Options:    newRootOptions(mappingValue(node, "options")),
+		Stages:     newStages(stagesNode),
+		node:       node,
+		stagesNode: stagesNode,
+	}
+}
+
+func newRootOptions(node *yaml.Node) *RootOptions {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	return &RootOptions{
+		ContainerOptions: newContainerOptions(mappingValue(node, "containerOptions")),
+		node:             node,
+	}
+}
+
+func newContainerOptions(node *yaml.Node) *ContainerOptions {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	return &ContainerOptions{
+		Env:  newEnvVars(mappingValue(node, "env")),
+		node: node,
+	}
+}
+
+func newStages(node *yaml.Node) []*Stage {
+	if node == nil {
+		return nil
+	}
+	stages := []*Stage{}
+	for _, item := range node.Content {
+		if item.Kind == yaml.MappingNode {
+			stages = append(stages, newStage(item))
+		}
+	}
+	return stages
+}
+
+func newStage(node *yaml.Node) *Stage {
+	stepsNode := sequenceValue(node, "steps")
+	stagesNode := sequenceValue(node, "stages")
+	parallelNode := sequenceValue(node, "parallel")
+	stage := &Stage{
+		Name:         scalarValue(node, "name"),
+		Stages:       newStages(stagesNode),
+		Parallel:     newStages(parallelNode),
+		node:         node,
+		stepsNode:    stepsNode,
+		stagesNode:   stagesNode,
+		parallelNode: parallelNode,
+	}
+	if stepsNode != nil {
+		stage.Steps = []*Step{}
+		for _, item := range stepsNode.Content {
+			if item.Kind == yaml.MappingNode {
+				stage.Steps = append(stage.Steps, newStep(item))
+			}
+		}
+	}
+	return stage
+}
+
+func newStep(node *yaml.Node) *Step {
+	step := &Step{
+		Name:    scalarValue(node, "name"),
+		Command: scalarValue(node, "command"),
+		Image:   scalarValue(node, "image"),
+		Sh:      scalarValue(node, "sh"),
+		node:    node,
+	}
+	if args := sequenceValue(node, "args"); args != nil {
+		for _, arg := range args.Content {
+			step.Args = append(step.Args, arg.Value)
+		}
+	}
+	return step
+}
+
+func newEnvVars(node *yaml.Node) *EnvVars {
+	if node == nil || node.Kind != yaml.SequenceNode {
+		return nil
+	}
+	env := &EnvVars{Vars: []*EnvVar{}, node: node}
+	for _, item := range node.Content {
+		env.Vars = append(env.Vars, &EnvVar{
+			Name:  scalarValue(item, "name"),
+			Value: scalarValue(item, "value"),
+			node:  item,
+		})
+	}
+	return env
+}
+
+// trailingBlankLines returns the blank lines that follow the last line of content. When the document ends
+// with a block scalar that keeps its trailing newlines, the blank lines are part of its value and are
+// written with it.
+func trailingBlankLines(content []byte, doc *yaml.Node) []byte {
+	last := doc
+	for len(last.Content) > 0 {
+		last = last.Content[len(last.Content)-1]
+	}
+	if last.Kind == yaml.ScalarNode && last.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 && strings.HasSuffix(last.Value, "\n\n") {
+		return nil
+	}
+	trimmed := bytes.TrimRight(content, "\n")
+	if len(content)-len(trimmed) < 2 {
+		return nil
+	}
+	return content[len(trimmed)+1:]
+}
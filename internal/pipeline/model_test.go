@@ -0,0 +1,199 @@
+package pipeline
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	yaml "gopkg.in/yaml.v3"
+)
+
+func TestParseProjectConfig(t *testing.T) {
+	config, err := LoadProjectConfig("../../test/model/jenkins-x-effective.yml")
+	assert.NoError(t, err)
+
+	assert.Equal(t, "none", config.BuildPack)
+	assert.Equal(t, "ORG", config.PipelineConfig.Env.Vars[0].Name)
+	assert.Nil(t, config.Pipeline("feature"))
+
+	pullRequest := config.Pipeline("pullRequest")
+	assert.NotNil(t, pullRequest)
+	assert.Nil(t, pullRequest.EnvVars())
+	assert.Equal(t, "build", pullRequest.Stages[0].Name)
+	assert.False(t, pullRequest.Stages[0].HasSteps())
+	assert.Equal(t, "verify", pullRequest.Stages[0].Stages[1].Name)
+	assert.Equal(t, "make-lint", pullRequest.Stages[0].Stages[1].Parallel[1].Steps[0].Name)
+	assert.Equal(t, "make lint", pullRequest.Stages[0].Stages[1].Parallel[1].Steps[0].Sh)
+	assert.Equal(t, []string{"build"}, pullRequest.Stages[0].Stages[0].Steps[0].Args)
+
+	release := config.Pipeline("release")
+	assert.Equal(t, "DEPLOY", release.EnvVars().Vars[0].Name)
+	assert.Equal(t, "true", release.EnvVars().Get("DEPLOY").Value)
+	assert.Equal(t, "DOCKER_CONFIG", release.Options.ContainerOptions.Env.Vars[0].Name)
+}
+
+func TestParseProjectConfig_buildPack(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"first", "buildPack: go\npipelineConfig: {}\n", "go"},
+		{"reordered", "pipelineConfig: {}\nbuildPack: maven\n", "maven"},
+		{"none", "buildPack: none\npipelineConfig:\n  extends: {file: go/pipeline.yaml}\n", "none"},
+		{"extends", "pipelineConfig:\n  extends:\n    import: classic\n    file: go/pipeline.yaml\n", "go"},
+		{"extends parent", "pipelineConfig:\n  extends: {file: ../javascript/pipeline.yaml}\n", "javascript"},
+		{"extends namespaced", "pipelineConfig:\n  extends: {file: ./packs/go/pipeline.yaml}\n", "packs/go"},
+		{"extends without directory", "pipelineConfig:\n  extends: {file: pipeline.yaml}\n", ""},
+		{"missing", "pipelineConfig: {}\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := ParseProjectConfig([]byte(tt.content))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, config.BuildPack)
+		})
+	}
+}
+
+func TestParseProjectConfig_empty(t *testing.T) {
+	_, err := ParseProjectConfig([]byte("\n"))
+	assert.Error(t, err)
+	_, err = ParseProjectConfig([]byte("- a\n"))
+	assert.Error(t, err)
+}
+
+func TestParsedPipeline_WalkStages(t *testing.T) {
+	config, err := LoadProjectConfig("../../test/model/jenkins-x-effective.yml")
+	assert.NoError(t, err)
+
+	visited := []string{}
+	config.Pipeline("pullRequest").WalkStages(func(stage *Stage, parents []*Stage) bool {
+		path := []string{}
+		for _, parent := range parents {
+			path = append(path, parent.Name)
+		}
+		visited = append(visited, strings.Join(append(path, stage.Name), "/"))
+		return true
+	})
+	assert.Equal(t, []string{"build", "build/compile", "build/verify", "build/verify/unit", "build/verify/lint", "package"}, visited)
+
+	visited = []string{}
+	config.Pipeline("pullRequest").WalkStages(func(stage *Stage, parents []*Stage) bool {
+		visited = append(visited, stage.Name)
+		return stage.Name != "unit"
+	})
+	assert.Equal(t, []string{"build", "compile", "verify", "unit"}, visited)
+}
+
+func TestProjectConfig_Save(t *testing.T) {
+	files, err := filepath.Glob("../../test/*/jenkins-x-effective.yml")
+	assert.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "sonar-scanner-test-model-")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, file := range files {
+		t.Run(file, func(t *testing.T) {
+			content, err := ioutil.ReadFile(file)
+			assert.NoError(t, err)
+			config, err := ParseProjectConfig(content)
+			assert.NoError(t, err)
+
+			saved := filepath.Join(dir, "jenkins-x-effective.yml")
+			assert.NoError(t, config.Save(saved))
+			got, err := ioutil.ReadFile(saved)
+			assert.NoError(t, err)
+			assert.Equal(t, string(content), string(got))
+		})
+	}
+}
+
+func TestProjectConfig_Bytes_roundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"blank lines between entries", "buildPack: go\n\npipelineConfig:\n  env:\n  - name: A\n    value: a\n\n  - name: B\n    value: b\n\n\n  agent:\n    image: go\n"},
+		{"anchored block mapping", "buildPack: go\nagent: &agent\n  image: go\n  label: jenkins-go\npipelineConfig:\n  agent: *agent\n"},
+		{"kept literal at the end", "buildPack: go\nnotes: |+\n  keep\n\n"},
+		{"kept literal at the end with blank lines", "buildPack: go\nnotes: |+\n  keep\n\n\n\n"},
+		{"clipped literal and blank lines at the end", "buildPack: go\nnotes: |\n  clip\n\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := ParseProjectConfig([]byte(tt.content))
+			assert.NoError(t, err)
+			got, err := config.Bytes()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.content, string(got))
+
+			// The data must not change even where the text does
+			var want, data interface{}
+			assert.NoError(t, yaml.Unmarshal([]byte(tt.content), &want))
+			assert.NoError(t, yaml.Unmarshal(got, &data))
+			assert.Equal(t, want, data)
+		})
+	}
+}
+
+func TestPipelineConfig_EnsureEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"no env", "pipelineConfig:\n  agent:\n    image: go\n", "pipelineConfig:\n  env:\n  - name: BUILDPACK_NAME\n    value: go\n  agent:\n    image: go\n"},
+		{"empty env", "pipelineConfig:\n  agent:\n    image: go\n  env:\n", "pipelineConfig:\n  agent:\n    image: go\n  env:\n  - name: BUILDPACK_NAME\n    value: go\n"},
+		{"null env", "pipelineConfig:\n  env: null # none yet\n  agent:\n    image: go\n", "pipelineConfig:\n  env: # none yet\n  - name: BUILDPACK_NAME\n    value: go\n  agent:\n    image: go\n"},
+		{"empty mapping env", "pipelineConfig:\n  env: {}\n  agent:\n    image: go\n", "pipelineConfig:\n  env:\n  - name: BUILDPACK_NAME\n    value: go\n  agent:\n    image: go\n"},
+		{"existing env", "pipelineConfig:\n  env:\n  - name: ORG\n    value: acme\n", "pipelineConfig:\n  env:\n  - name: BUILDPACK_NAME\n    value: go\n  - name: ORG\n    value: acme\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := ParseProjectConfig([]byte(tt.content))
+			assert.NoError(t, err)
+			env, err := config.PipelineConfig.EnsureEnv()
+			assert.NoError(t, err)
+			env.Insert(0, "BUILDPACK_NAME", "go")
+			assert.NotNil(t, config.PipelineConfig.Env)
+
+			got, err := config.Bytes()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, string(got))
+			var data interface{}
+			assert.NoError(t, yaml.Unmarshal(got, &data), "duplicate keys are rejected")
+		})
+	}
+}
+
+func TestPipelineConfig_EnsureEnv_invalid(t *testing.T) {
+	config, err := ParseProjectConfig([]byte("pipelineConfig:\n  env:\n    ORG: acme\n"))
+	assert.NoError(t, err)
+	_, err = config.PipelineConfig.EnsureEnv()
+	assert.EqualError(t, err, "unable to add to env: of pipelineConfig on line 3, expected a list")
+
+	content, err := config.Bytes()
+	assert.NoError(t, err)
+	assert.Equal(t, "pipelineConfig:\n  env:\n    ORG: acme\n", string(content))
+}
+
+func TestProjectConfig_modify(t *testing.T) {
+	config, err := LoadProjectConfig("../../test/model/jenkins-x-effective.yml")
+	assert.NoError(t, err)
+
+	config.PipelineConfig.Env.Insert(1, "TEAM", "blue")
+	stage := config.Pipeline("pullRequest").Stages[0].Stages[0]
+	stage.InsertStep(0, NewStep("lint", "make", []string{"lint"}, "go"))
+
+	content, err := config.Bytes()
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "  - name: ORG\n    value: acme\n  - name: TEAM\n    value: blue\n")
+	assert.Contains(t, string(content), "            steps:\n            - command: make\n              args:\n              - lint\n              image: go\n              name: lint\n")
+	assert.Equal(t, "lint", stage.Steps[0].Name)
+	assert.Equal(t, 1, stage.IndexOfStep(stage.Steps[1]))
+}
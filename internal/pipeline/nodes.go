@@ -0,0 +1,92 @@
+package pipeline
+
+import (
+	yaml "gopkg.in/yaml.v3"
+)
+
+// mappingValue returns the value stored under key in the given mapping node, or nil if there is none
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// scalarValue returns the scalar stored under key in the given mapping node, or "" if there is none
+func scalarValue(node *yaml.Node, key string) string {
+	value := mappingValue(node, key)
+	if value == nil || value.Kind != yaml.ScalarNode {
+		return ""
+	}
+	return value.Value
+}
+
+// rootNode returns the top level node of a parsed document
+func rootNode(doc *yaml.Node) *yaml.Node {
+	if doc.Kind == yaml.DocumentNode {
+		if len(doc.Content) == 0 {
+			return nil
+		}
+		return doc.Content[0]
+	}
+	return doc
+}
+
+// insertNodes inserts nodes into the content of a sequence or mapping node at the given index
+func insertNodes(parent *yaml.Node, index int, nodes ...*yaml.Node) {
+	content := make([]*yaml.Node, 0, len(parent.Content)+len(nodes))
+	content = append(content, parent.Content[:index]...)
+	content = append(content, nodes...)
+	content = append(content, parent.Content[index:]...)
+	parent.Content = content
+}
+
+// indexOfNode finds the position of node within the content of parent
+func indexOfNode(parent *yaml.Node, node *yaml.Node) int {
+	for i, child := range parent.Content {
+		if child == node {
+			return i
+		}
+	}
+	return -1
+}
+
+// newStringNode creates a scalar node holding a string
+func newStringNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
+
+// newMappingNode creates a block mapping from alternating keys and values
+func newMappingNode(content ...*yaml.Node) *yaml.Node {
+	return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: content}
+}
+
+// newSequenceNode creates a block sequence holding the given items
+func newSequenceNode(items ...*yaml.Node) *yaml.Node {
+	return &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: items}
+}
+
+// sequenceValue returns the sequence stored under key in the given mapping node, or nil if there is none
+func sequenceValue(node *yaml.Node, key string) *yaml.Node {
+	value := mappingValue(node, key)
+	if value == nil || value.Kind != yaml.SequenceNode {
+		return nil
+	}
+	return value
+}
+
+// setMappingValue replaces the value stored under key in the given mapping node, appending the key if it is absent
+func setMappingValue(node *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content[i+1] = value
+			return
+		}
+	}
+	node.Content = append(node.Content, newStringNode(key), value)
+}
@@ -0,0 +1,144 @@
+package pipeline
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// DefaultSQServer is the SonarQube server scanned against unless another one is given
+const DefaultSQServer = "http://jx-sonarqube.sonarqube.svc.cluster.local:9000"
+
+// Options are the options of the configure command, which it passes on to exec-sonar-scanner.sh
+type Options struct {
+	SQServer      string `yaml:"sqServer"`
+	APIKey        string `yaml:"apiKey"`
+	ScanOnPreview bool   `yaml:"scanonpreview"`
+	ScanOnRelease bool   `yaml:"scanonrelease"`
+	ScanOnFeature bool   `yaml:"scanonfeature"`
+	Context       string `yaml:"pipeline-context"`
+}
+
+// option describes one of the Options
+type option struct {
+	name string
+	// env lists the environment variables that set the option, the first one set wins. The option's own
+	// variable comes before the one exec-sonar-scanner.sh reads.
+	env     []string
+	boolean bool
+	// secret options are masked in the log
+	secret bool
+}
+
+var configureOptions = []option{
+	{name: "sqServer", env: []string{"SQSERVER", "SONARQUBE_SERVER"}},
+	{name: "apiKey", env: []string{"APIKEY", "SONAR_TOKEN"}, secret: true},
+	{name: "scanonpreview", env: []string{"SCANONPREVIEW", "SCAN_ON_PREVIEW"}, boolean: true},
+	{name: "scanonrelease", env: []string{"SCANONRELEASE", "SCAN_ON_RELEASE"}, boolean: true},
+	{name: "scanonfeature", env: []string{"SCANONFEATURE", "SCAN_ON_FEATURE"}, boolean: true},
+	{name: "pipeline-context", env: []string{"PIPELINE_CONTEXT"}},
+}
+
+// DefaultOptions returns the built-in defaults of the options
+func DefaultOptions() Options {
+	return Options{
+		SQServer:      DefaultSQServer,
+		ScanOnPreview: true,
+		ScanOnRelease: true,
+	}
+}
+
+// optionsSchema describes the options, so that they are merged like the user overrides
+func optionsSchema() *schema {
+	s := &schema{Type: schemaTypeObject, Properties: map[string]*schema{}}
+	for _, o := range configureOptions {
+		s.Properties[o.name] = &schema{Type: schemaTypeString}
+		if o.boolean {
+			s.Properties[o.name].Type = schemaTypeBoolean
+		}
+	}
+	return s
+}
+
+// LoadOptions merges the built-in defaults of the options, the environment and the flags given on the command
+// line, in that order, recording where each option came from. flags holds the value of each flag that was set,
+// by the name of its option.
+func LoadOptions(flags map[string]string, getenv func(string) string) (Options, Provenance, error) {
+	options := Options{}
+
+	defaults := &yaml.Node{}
+	err := defaults.Encode(DefaultOptions())
+	if err != nil {
+		return options, nil, errors.Wrap(err, "unable to encode the default options")
+	}
+	layers := []configLayer{{node: defaults, source: func(string) string { return "default" }}}
+
+	env := newMappingNode()
+	envSources := map[string]string{}
+	for _, o := range configureOptions {
+		for _, name := range o.env {
+			value := getenv(name)
+			if value == "" {
+				continue
+			}
+			node, err := optionNode(o, value)
+			if err != nil {
+				return options, nil, errors.Wrapf(err, "invalid value for %s", name)
+			}
+			setMappingValue(env, o.name, node)
+			envSources[o.name] = fmt.Sprintf("env (%s)", name)
+			break
+		}
+	}
+	layers = append(layers, configLayer{node: env, source: func(path string) string { return envSources[path] }})
+
+	flagLayer := newMappingNode()
+	for _, o := range configureOptions {
+		value, ok := flags[o.name]
+		if !ok {
+			continue
+		}
+		node, err := optionNode(o, value)
+		if err != nil {
+			return options, nil, errors.Wrapf(err, "invalid value for --%s", o.name)
+		}
+		setMappingValue(flagLayer, o.name, node)
+	}
+	layers = append(layers, configLayer{node: flagLayer, source: func(path string) string {
+		return fmt.Sprintf("flag (--%s)", path)
+	}})
+
+	merged := newMappingNode()
+	provenance := Provenance{}
+	for _, layer := range layers {
+		mergeNodes(merged, layer.node, optionsSchema(), "", func(path string, value *yaml.Node) {
+			provenance[path] = Source{Value: describeValue(value), Layer: layer.source(path)}
+		})
+	}
+	for _, o := range configureOptions {
+		if source, ok := provenance[o.name]; ok && o.secret && source.Value != "" {
+			source.Value = "***"
+			provenance[o.name] = source
+		}
+	}
+
+	err = merged.Decode(&options)
+	if err != nil {
+		return Options{}, nil, errors.Wrap(err, "unable to decode merged options")
+	}
+	return options, provenance, nil
+}
+
+// optionNode parses the value of an option given as a string
+func optionNode(o option, value string) (*yaml.Node, error) {
+	if !o.boolean {
+		return newStringNode(value), nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, errors.Errorf("'%s', expected true or false", value)
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(b)}, nil
+}
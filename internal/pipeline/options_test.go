@@ -0,0 +1,120 @@
+package pipeline
+
+import (
+	"io/ioutil"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadOptions(t *testing.T) {
+	tests := []struct {
+		name           string
+		flags          map[string]string
+		env            map[string]string
+		want           Options
+		wantProvenance Provenance
+		wantErr        string
+	}{
+		{
+			name: "defaults",
+			want: DefaultOptions(),
+			wantProvenance: Provenance{
+				"sqServer":         {DefaultSQServer, "default"},
+				"apiKey":           {"", "default"},
+				"scanonpreview":    {"true", "default"},
+				"scanonrelease":    {"true", "default"},
+				"scanonfeature":    {"false", "default"},
+				"pipeline-context": {"", "default"},
+			},
+		},
+		{
+			name: "script variables",
+			env: map[string]string{
+				"SONARQUBE_SERVER": "http://sonar.acme.com",
+				"SONAR_TOKEN":      "12345",
+				"SCAN_ON_FEATURE":  "true",
+			},
+			want: Options{SQServer: "http://sonar.acme.com", APIKey: "12345", ScanOnPreview: true, ScanOnRelease: true, ScanOnFeature: true},
+			wantProvenance: Provenance{
+				"sqServer":         {"http://sonar.acme.com", "env (SONARQUBE_SERVER)"},
+				"apiKey":           {"***", "env (SONAR_TOKEN)"},
+				"scanonpreview":    {"true", "default"},
+				"scanonrelease":    {"true", "default"},
+				"scanonfeature":    {"true", "env (SCAN_ON_FEATURE)"},
+				"pipeline-context": {"", "default"},
+			},
+		},
+		{
+			name: "options override script variables and flags override both",
+			flags: map[string]string{
+				"scanonrelease":    "false",
+				"pipeline-context": "backend",
+				"dry-run":          "true",
+			},
+			env: map[string]string{
+				"SQSERVER":         "http://sonar.acme.com",
+				"SONARQUBE_SERVER": "http://sonar.example.com",
+				"SCAN_ON_RELEASE":  "true",
+				"PIPELINE_CONTEXT": "frontend",
+			},
+			want: Options{SQServer: "http://sonar.acme.com", ScanOnPreview: true, Context: "backend"},
+			wantProvenance: Provenance{
+				"sqServer":         {"http://sonar.acme.com", "env (SQSERVER)"},
+				"apiKey":           {"", "default"},
+				"scanonpreview":    {"true", "default"},
+				"scanonrelease":    {"false", "flag (--scanonrelease)"},
+				"scanonfeature":    {"false", "default"},
+				"pipeline-context": {"backend", "flag (--pipeline-context)"},
+			},
+		},
+		{
+			name:    "invalid boolean",
+			env:     map[string]string{"SCAN_ON_PREVIEW": "yes"},
+			wantErr: "invalid value for SCAN_ON_PREVIEW: 'yes', expected true or false",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, provenance, err := LoadOptions(tt.flags, func(key string) string { return tt.env[key] })
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantProvenance, provenance)
+		})
+	}
+}
+
+func TestPatcher_ConfigurePipeline_optionProvenance(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	level := log.GetLevel()
+	log.SetLevel(log.DebugLevel)
+	defer log.SetLevel(level)
+
+	options, provenance, err := LoadOptions(map[string]string{"apiKey": "12345"}, func(key string) string {
+		return map[string]string{"SONARQUBE_SERVER": "http://sonar.acme.com"}[key]
+	})
+	assert.NoError(t, err)
+	e := NewPatcher("../../test/go", options.Context, options.SQServer, options.APIKey, options.ScanOnPreview, options.ScanOnRelease, options.ScanOnFeature)
+	e.SetOptionProvenance(provenance)
+	e.SetDryRun(true)
+	e.out = ioutil.Discard
+	e.env = func(string) string { return "" }
+	err = e.ConfigurePipeline()
+	assert.NoError(t, err)
+
+	messages := []string{}
+	for _, entry := range hook.AllEntries() {
+		messages = append(messages, entry.Message)
+	}
+	assert.Contains(t, messages, "setting sqServer=http://sonar.acme.com from env (SONARQUBE_SERVER)")
+	assert.Contains(t, messages, "setting apiKey=*** from flag (--apiKey)")
+	assert.Contains(t, messages, "setting scanonrelease=true from default")
+	assert.Contains(t, messages, "setting skip=false from default")
+}
@@ -0,0 +1,596 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jenkins-x-apps/jx-app-sonar-scanner/internal/util"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v3"
+)
+
+const (
+	schemaTypeObject  = "object"
+	schemaTypeString  = "string"
+	schemaTypeBoolean = "boolean"
+	schemaTypeArray   = "array"
+
+	schemaFormatDate       = "date"
+	schemaFormatPercentage = "percentage"
+)
+
+var (
+	yamlErrorLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+)
+
+// schema describes the values allowed in the user overrides file. It drives both the strict
+// validation of the file and the JSON Schema published for editors and CI checks.
+type schema struct {
+	Type          string
+	Description   string
+	Enum          []string
+	Properties    map[string]*schema
+	MinProperties int
+	Items         *schema
+	// AdditionalProperties describes the values of an object whose keys are not known in advance
+	AdditionalProperties *schema
+	// OneOf lists the alternative forms of a value, told apart by whether it is a mapping, a list or a scalar
+	OneOf []*schema
+	// Format further constrains a string, either schemaFormatDate or schemaFormatPercentage
+	Format string
+	// Required lists the fields an object must set
+	Required []string
+	// Excluded names fields an object does not take, although related files do, along with the reason
+	Excluded map[string]string
+}
+
+// buildStepsSchema describes the insertion points of the scans in one kind of pipeline
+func buildStepsSchema(pipeline string) *schema {
+	return &schema{
+		Description: fmt.Sprintf("Where to insert the scan in %s pipelines, or a list of places to insert several scans.", pipeline),
+		OneOf: []*schema{
+			buildStepSchema(pipeline),
+			{
+				Type:  schemaTypeArray,
+				Items: buildStepSchema(pipeline),
+			},
+		},
+	}
+}
+
+// buildStepSchema describes the insertion point of a scan in one kind of pipeline
+func buildStepSchema(pipeline string) *schema {
+	return &schema{
+		Type:        schemaTypeObject,
+		Description: fmt.Sprintf("Where to insert a scan in %s pipelines.", pipeline),
+		Properties: map[string]*schema{
+			"name": {
+				Type:        schemaTypeString,
+				Description: "The name of the scan step, sonar-scanner by default. Each scan of a pipeline needs its own name.",
+			},
+			"stage": {
+				Type:        schemaTypeString,
+				Description: "The stage, or path of nested stages separated by /, to anchor the scan to. Prefix with glob: or regex: to match loosely.",
+			},
+			"step": {
+				Type:        schemaTypeString,
+				Description: "The step to anchor the scan to. Prefix with glob: or regex: to match loosely.",
+			},
+			"position": {
+				Type:        schemaTypeString,
+				Description: "Where to insert the scan relative to the stage and step.",
+				Enum:        []string{PositionAfter, PositionBefore, PositionFirstInStage, PositionLastInStage, PositionNewStage},
+			},
+			"properties": propertiesSchema(fmt.Sprintf("SonarQube analysis properties for this scan of %s pipelines only, on top of the shared properties.", pipeline)),
+		},
+	}
+}
+
+// propertiesSchema describes a map of SonarQube analysis properties
+func propertiesSchema(description string) *schema {
+	return &schema{
+		Type:                 schemaTypeObject,
+		Description:          description,
+		AdditionalProperties: &schema{Type: schemaTypeString},
+	}
+}
+
+// userOverridesSchema describes the whole user overrides file
+func userOverridesSchema() *schema {
+	return &schema{
+		Type:        schemaTypeObject,
+		Description: "Configuration of jx-app-sonar-scanner for a single repository.",
+		Excluded: map[string]string{
+			"rollout": "the rollout is only read from the org defaults or the environment",
+		},
+		Properties: map[string]*schema{
+			"verbose": {
+				Type:        schemaTypeBoolean,
+				Description: "Log the pipeline before and after patching and run the scanner verbosely.",
+			},
+			"discover": {
+				Type:        schemaTypeBoolean,
+				Description: "When neither the build pack nor these overrides give an anchor, insert the scan after the last step of the first stage that builds or tests the project, such as make test, mvn install, gradle build, npm test, pytest or sbt test.",
+			},
+			"skip": {
+				Description: "Do not scan this repository. The skip is recorded in the build log.",
+				OneOf: []*schema{
+					{Type: schemaTypeBoolean},
+					{
+						Type:          schemaTypeObject,
+						Description:   "An exemption from scanning, recorded in the build log with all of its fields.",
+						MinProperties: 1,
+						Properties: map[string]*schema{
+							"reason": {
+								Type:        schemaTypeString,
+								Description: "Why the repository is not scanned.",
+							},
+							"ticket": {
+								Type:        schemaTypeString,
+								Description: "The ticket tracking the exemption.",
+							},
+							"owner": {
+								Type:        schemaTypeString,
+								Description: "Who answers for the exemption.",
+							},
+							"until": {
+								Type:        schemaTypeString,
+								Format:      schemaFormatDate,
+								Description: "The last day of the exemption, as YYYY-MM-DD. Later builds are scanned and warn about the expired skip.",
+							},
+						},
+					},
+				},
+			},
+			"pullRequest": buildStepsSchema("pull request"),
+			"release":     buildStepsSchema("release"),
+			"feature":     buildStepsSchema("feature branch"),
+			"paths": {
+				Type:        schemaTypeObject,
+				Description: "Scan pull requests only when they change files selected by these globs, relative to the repository root. ** matches any number of directories.",
+				Properties: map[string]*schema{
+					"include": {
+						Type:        schemaTypeArray,
+						Description: "Only changes to files matching one of these globs are relevant.",
+						Items:       &schema{Type: schemaTypeString},
+					},
+					"exclude": {
+						Type:        schemaTypeArray,
+						Description: "Changes to files matching one of these globs are not relevant.",
+						Items:       &schema{Type: schemaTypeString},
+					},
+				},
+			},
+			"properties": propertiesSchema("SonarQube analysis properties, such as sonar.exclusions, added to those of the build pack. sonar.host.url, sonar.login and sonar.projectKey are set by the scan."),
+			"rules": {
+				Type:        schemaTypeObject,
+				Description: "Decide from the build environment whether to scan.",
+				Properties: map[string]*schema{
+					"skip": {
+						Type:        schemaTypeArray,
+						Description: "Skip the scan when any of these rules matches.",
+						Items:       skipRuleSchema(),
+					},
+					"only": {
+						Type:        schemaTypeArray,
+						Description: "Scan only when one of these rules matches.",
+						Items:       skipRuleSchema(),
+					},
+				},
+			},
+		},
+	}
+}
+
+// settingsSchema describes every setting: those of the repo override file and the rollout, which only the org
+// defaults and the environment set
+func settingsSchema() *schema {
+	s := userOverridesSchema()
+	s.Properties["rollout"] = rolloutSchema()
+	s.Excluded = nil
+	return s
+}
+
+// rolloutSchema describes the share of repositories scanned
+func rolloutSchema() *schema {
+	return &schema{
+		Description: "Scan only part of the repositories, to turn scanning on gradually.",
+		OneOf: []*schema{
+			{
+				Type:        schemaTypeString,
+				Format:      schemaFormatPercentage,
+				Description: "The share of repositories scanned, such as 25%.",
+			},
+			{
+				Type:          schemaTypeObject,
+				MinProperties: 1,
+				Properties: map[string]*schema{
+					"percentage": {
+						Type:        schemaTypeString,
+						Format:      schemaFormatPercentage,
+						Description: "The share of repositories scanned, such as 25%, chosen by a stable hash of REPO_OWNER/REPO_NAME.",
+					},
+					"orgs": {
+						Type:        schemaTypeArray,
+						Description: "Shell patterns of the REPO_OWNER of repositories scanned whatever the percentage.",
+						Items:       &schema{Type: schemaTypeString},
+					},
+				},
+			},
+		},
+	}
+}
+
+// skipRuleSchema describes a rule matching the build environment
+func skipRuleSchema() *schema {
+	return &schema{
+		Type:          schemaTypeObject,
+		Description:   "Matches when every pattern given matches. Patterns are shell globs.",
+		MinProperties: 1,
+		Properties: map[string]*schema{
+			"kind": {
+				Type:        schemaTypeString,
+				Description: "Pattern for the kind of pipeline, PIPELINE_KIND: pullrequest, release or feature.",
+			},
+			"branch": {
+				Type:        schemaTypeString,
+				Description: "Pattern for the branch being built, BRANCH_NAME.",
+			},
+			"baseBranch": {
+				Type:        schemaTypeString,
+				Description: "Pattern for the branch a pull request merges into, PULL_BASE_REF.",
+			},
+		},
+	}
+}
+
+// Problem is a single violation of the user overrides schema
+type Problem struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Column == 0 {
+		return fmt.Sprintf("%d: %s", p.Line, p.Message)
+	}
+	return fmt.Sprintf("%d:%d: %s", p.Line, p.Column, p.Message)
+}
+
+// ValidateUserOverrides checks the content of a user overrides file against the schema and
+// returns every problem found, in the order in which they appear in the file.
+func ValidateUserOverrides(content []byte) []Problem {
+	return validateSettings(content, userOverridesSchema())
+}
+
+// validateOrgDefaults checks the content of an org defaults file, which may also set the rollout
+func validateOrgDefaults(content []byte) []Problem {
+	return validateSettings(content, settingsSchema())
+}
+
+// validateSettings checks the content of a file holding the settings described by settings, in either format
+func validateSettings(content []byte, settings *schema) []Problem {
+	doc := &yaml.Node{}
+	err := yaml.Unmarshal(content, doc)
+	if err != nil {
+		return []Problem{yamlProblem(err)}
+	}
+	if doc.Kind == 0 {
+		// An empty file overrides nothing
+		return nil
+	}
+	root := rootNode(doc)
+	if root == nil {
+		return nil
+	}
+	problems := []Problem{}
+	if isLegacy(root) {
+		settings.validate(root, "", &problems)
+	} else {
+		documentSchema(settings).validate(root, "", &problems)
+	}
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].Line != problems[j].Line {
+			return problems[i].Line < problems[j].Line
+		}
+		return problems[i].Column < problems[j].Column
+	})
+	return problems
+}
+
+// validate checks node against the schema, collecting problems. path names the node in messages.
+func (s *schema) validate(node *yaml.Node, path string, problems *[]Problem) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		return
+	}
+	report := func(node *yaml.Node, format string, args ...interface{}) {
+		*problems = append(*problems, Problem{Line: node.Line, Column: node.Column, Message: fmt.Sprintf(format, args...)})
+	}
+	describe := "the file"
+	if path != "" {
+		describe = fmt.Sprintf("'%s'", path)
+	}
+
+	if len(s.OneOf) > 0 {
+		alternative := s.alternative(node)
+		if alternative == nil {
+			forms := []string{}
+			for _, alternative := range s.OneOf {
+				forms = append(forms, alternative.form())
+			}
+			report(node, "expected %s to be %s", describe, strings.Join(forms, ", or "))
+			return
+		}
+		alternative.validate(node, path, problems)
+		return
+	}
+
+	switch s.Type {
+	case schemaTypeObject:
+		if node.Kind != yaml.MappingNode {
+			report(node, "expected %s to be a mapping", describe)
+			return
+		}
+		for _, name := range s.Required {
+			if mappingValue(node, name) == nil {
+				report(node, "expected %s to set '%s'", describe, name)
+			}
+		}
+		if len(node.Content)/2 < s.MinProperties {
+			report(node, "expected %s to set at least %d of: %s", describe, s.MinProperties, strings.Join(s.propertyNames(), ", "))
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			field := key.Value
+			if path != "" {
+				field = path + "." + key.Value
+			}
+			property := s.property(key.Value)
+			if property == nil {
+				report(key, "unknown field '%s'%s", field, s.suggest(key.Value))
+				continue
+			}
+			property.validate(value, field, problems)
+		}
+	case schemaTypeArray:
+		if node.Kind != yaml.SequenceNode {
+			report(node, "expected %s to be a list", describe)
+			return
+		}
+		for i, item := range node.Content {
+			s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i), problems)
+		}
+	case schemaTypeBoolean:
+		if node.Kind != yaml.ScalarNode || node.Tag != "!!bool" {
+			report(node, "expected %s to be true or false", describe)
+		}
+	case schemaTypeString:
+		if node.Kind != yaml.ScalarNode {
+			report(node, "expected %s to be a string", describe)
+			return
+		}
+		if len(s.Enum) > 0 && !util.Contains(s.Enum, node.Value) {
+			report(node, "invalid value '%s' for %s, expected one of: %s", node.Value, describe, strings.Join(s.Enum, ", "))
+		}
+		if s.Format == schemaFormatDate {
+			if _, err := time.Parse(dateFormat, node.Value); err != nil {
+				report(node, "invalid date '%s' for %s, expected YYYY-MM-DD", node.Value, describe)
+			}
+		}
+		if s.Format == schemaFormatPercentage {
+			if _, err := parsePercentage(node.Value); err != nil {
+				report(node, "invalid percentage '%s' for %s, expected 0%% to 100%%", node.Value, describe)
+			}
+		}
+	}
+}
+
+// property returns the schema of a field of an object, or nil if the object has no such field
+func (s *schema) property(name string) *schema {
+	if property, ok := s.Properties[name]; ok {
+		return property
+	}
+	return s.AdditionalProperties
+}
+
+// alternative returns the form of a OneOf schema matching the kind of node, if there is one
+func (s *schema) alternative(node *yaml.Node) *schema {
+	for _, alternative := range s.OneOf {
+		switch alternative.Type {
+		case schemaTypeObject:
+			if node.Kind == yaml.MappingNode {
+				return alternative
+			}
+		case schemaTypeArray:
+			if node.Kind == yaml.SequenceNode {
+				return alternative
+			}
+		default:
+			if node.Kind == yaml.ScalarNode {
+				return alternative
+			}
+		}
+	}
+	return nil
+}
+
+// scalar returns the schema of a value given as a single string or boolean, if the schema allows one
+func (s *schema) scalar() *schema {
+	if len(s.OneOf) > 0 {
+		return s.alternative(&yaml.Node{Kind: yaml.ScalarNode})
+	}
+	if s.Type == schemaTypeString || s.Type == schemaTypeBoolean {
+		return s
+	}
+	return nil
+}
+
+// form describes the values of a type in messages
+func (s *schema) form() string {
+	switch s.Type {
+	case schemaTypeObject:
+		return "a mapping"
+	case schemaTypeArray:
+		return "a list"
+	case schemaTypeBoolean:
+		return "true or false"
+	default:
+		return "a string"
+	}
+}
+
+// suggest lists the fields allowed alongside an unknown one
+func (s *schema) suggest(field string) string {
+	if reason, ok := s.Excluded[field]; ok {
+		return ", " + reason
+	}
+	for name := range s.Properties {
+		if strings.EqualFold(name, field) {
+			return fmt.Sprintf(", did you mean '%s'?", name)
+		}
+	}
+	return fmt.Sprintf(", expected one of: %s", strings.Join(s.propertyNames(), ", "))
+}
+
+// propertyNames returns the sorted names of the properties of an object
+func (s *schema) propertyNames() []string {
+	names := []string{}
+	for name := range s.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// jsonSchema converts the schema to its JSON Schema representation
+func (s *schema) jsonSchema() map[string]interface{} {
+	out := map[string]interface{}{}
+	if s.Description != "" {
+		out["description"] = s.Description
+	}
+	if len(s.OneOf) > 0 {
+		oneOf := []interface{}{}
+		for _, alternative := range s.OneOf {
+			oneOf = append(oneOf, alternative.jsonSchema())
+		}
+		out["oneOf"] = oneOf
+		return out
+	}
+	out["type"] = s.Type
+	if s.Format != "" {
+		out["format"] = s.Format
+	}
+	if len(s.Enum) > 0 {
+		out["enum"] = s.Enum
+	}
+	if s.Type == schemaTypeObject {
+		properties := map[string]interface{}{}
+		for name, property := range s.Properties {
+			properties[name] = property.jsonSchema()
+		}
+		out["properties"] = properties
+		out["additionalProperties"] = false
+		if s.AdditionalProperties != nil {
+			delete(out, "properties")
+			out["additionalProperties"] = s.AdditionalProperties.jsonSchema()
+		}
+		if s.MinProperties > 0 {
+			out["minProperties"] = s.MinProperties
+		}
+		if len(s.Required) > 0 {
+			out["required"] = s.Required
+		}
+	}
+	if s.Type == schemaTypeArray {
+		out["items"] = s.Items.jsonSchema()
+	}
+	return out
+}
+
+// UserOverridesSchema returns the JSON Schema of the user overrides file
+func UserOverridesSchema() ([]byte, error) {
+	out := documentSchema(userOverridesSchema()).jsonSchema()
+	out["$schema"] = "http://json-schema.org/draft-07/schema#"
+	out["$id"] = "https://github.com/jenkins-x-apps/jx-app-sonar-scanner/schema/jx-app-sonar-scanner.schema.json"
+	out["title"] = userOverridesFile
+	content, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to serialise schema")
+	}
+	return append(content, '\n'), nil
+}
+
+// parseUserOverrides strictly decodes a user overrides file in either format, rejecting anything the schema does not allow
+func parseUserOverrides(content []byte) (UserOverrides, error) {
+	userOverrides := UserOverrides{}
+	problems := ValidateUserOverrides(content)
+	if len(problems) > 0 {
+		return userOverrides, problemsError(problems)
+	}
+	doc := &yaml.Node{}
+	err := yaml.Unmarshal(content, doc)
+	if err != nil {
+		return userOverrides, err
+	}
+	if doc.Kind == 0 {
+		return userOverrides, nil
+	}
+	spec := specNode(rootNode(doc))
+	if spec == nil {
+		return userOverrides, nil
+	}
+	err = spec.Decode(&userOverrides)
+	if err != nil {
+		return userOverrides, err
+	}
+	return userOverrides, nil
+}
+
+// checkUserOverrides logs every problem of the repo override file and reports whether the scan is skipped
+// because of them. An invalid file leaves the project unscanned rather than breaking its build, failing is
+// left to sonar-scanner validate.
+func (e *Patcher) checkUserOverrides(file string) (bool, string, error) {
+	path := filepath.Join(e.sourceDir, file)
+	if !util.Exists(path) {
+		return false, "", nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, "", errors.Errorf("failed to open '%s'", path)
+	}
+	problems := ValidateUserOverrides(content)
+	if len(problems) == 0 {
+		return false, "", nil
+	}
+	for _, problem := range problems {
+		logger.Errorf("%s:%s", path, problem)
+	}
+	log.WithFields(log.Fields{
+		"sonarscanskip": true,
+		"file":          path,
+		"problems":      len(problems),
+	}).Warnf("Skipping sonar scan as %s is invalid, run 'sonar-scanner validate' to check it", file)
+	return true, fmt.Sprintf("invalid %s", file), nil
+}
+
+// yamlProblem converts a YAML syntax error into a problem, keeping the line where the parser reports one
+func yamlProblem(err error) Problem {
+	message := strings.TrimPrefix(err.Error(), "yaml: ")
+	if match := yamlErrorLine.FindStringSubmatch(message); match != nil {
+		line, _ := strconv.Atoi(match[1])
+		return Problem{Line: line, Message: match[2]}
+	}
+	return Problem{Line: 1, Column: 1, Message: message}
+}
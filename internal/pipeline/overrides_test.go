@@ -0,0 +1,104 @@
+package pipeline
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateUserOverrides(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"empty", "", []string{}},
+		{"document marker only", "---\n", []string{}},
+		{"valid", "---\nverbose: true\nskip: false\npullRequest:\n    stage: build/verify\n    step: glob:make-*\n    position: before\nfeature:\n", []string{}},
+		{"not a mapping", "sisnhthtnoetentrhtte", []string{"1:1: expected the file to be a mapping"}},
+		{"syntax error", "pullRequest: [\n", []string{"1: did not find expected node content"}},
+		{"unknown field", "verbose: true\nverbsoe: true\n", []string{"2:1: unknown field 'verbsoe', expected one of: discover, feature, paths, properties, pullRequest, release, rules, skip, verbose"}},
+		{"wrong case", "pullrequest:\n  stage: build\n", []string{"1:1: unknown field 'pullrequest', did you mean 'pullRequest'?"}},
+		{"rules", "rules:\n  skip:\n  - branch: renovate/*\n  - {}\n  only: main\n", []string{
+			"4:5: expected 'rules.skip[1]' to set at least 1 of: baseBranch, branch, kind",
+			"5:9: expected 'rules.only' to be a list",
+		}},
+		{"skip exemption", "skip:\n  reason: legacy code\n  ticket: GOV-12\n  owner: team-a\n  until: 2026-12-31\n", []string{}},
+		{"skip problems", "skip:\n  reasno: legacy code\n  until: next week\n", []string{
+			"2:3: unknown field 'skip.reasno', expected one of: owner, reason, ticket, until",
+			"3:10: invalid date 'next week' for 'skip.until', expected YYYY-MM-DD",
+		}},
+		{"skip list", "skip: [true]\n", []string{"1:7: expected 'skip' to be true or false, or a mapping"}},
+		{"rollout", "rollout: 25%\n", []string{"1:1: unknown field 'rollout', the rollout is only read from the org defaults or the environment"}},
+		{"versioned rollout", "apiVersion: jx-app-sonar-scanner.jenkins-x.io/v1\nkind: SonarScannerConfig\nspec:\n  rollout: 25%\n", []string{
+			"4:3: unknown field 'spec.rollout', the rollout is only read from the org defaults or the environment",
+		}},
+		{"versioned", "apiVersion: jx-app-sonar-scanner.jenkins-x.io/v1\nkind: SonarScannerConfig\nspec:\n  verbose: true\n", []string{}},
+		{"versioned problems", "apiVersion: jx-app-sonar-scanner.jenkins-x.io/v2\nspec:\n  pullRequest:\n    stpe: make\n", []string{
+			"1:1: expected the file to set 'kind'",
+			"1:13: invalid value 'jx-app-sonar-scanner.jenkins-x.io/v2' for 'apiVersion', expected one of: jx-app-sonar-scanner.jenkins-x.io/v1",
+			"4:5: unknown field 'spec.pullRequest.stpe', expected one of: name, position, properties, stage, step",
+		}},
+		{"versioned settings at top level", "apiVersion: jx-app-sonar-scanner.jenkins-x.io/v1\nkind: SonarScannerConfig\nverbose: true\n", []string{
+			"3:1: unknown field 'verbose', expected one of: apiVersion, kind, spec",
+		}},
+		{"scan list", "pullRequest:\n- name: sonar-unit\n  step: make-test\n- name: sonar-integration\n  stpe: make-it\n", []string{
+			"5:3: unknown field 'pullRequest[1].stpe', expected one of: name, position, properties, stage, step",
+		}},
+		{"scan scalar", "release: make-test\n", []string{"1:10: expected 'release' to be a mapping, or a list"}},
+		{"every problem", "skip: yes please\nrelease:\n  stage: [build]\n  setp: make\n  position: middle\n", []string{
+			"1:7: expected 'skip' to be true or false",
+			"3:10: expected 'release.stage' to be a string",
+			"4:3: unknown field 'release.setp', expected one of: name, position, properties, stage, step",
+			"5:13: invalid value 'middle' for 'release.position', expected one of: after, before, first-in-stage, last-in-stage, new-stage",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, problem := range ValidateUserOverrides([]byte(tt.content)) {
+				got = append(got, problem.String())
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_validateOrgDefaults(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"rollout", "rollout: 25%\n", []string{}},
+		{"versioned rollout", "apiVersion: jx-app-sonar-scanner.jenkins-x.io/v1\nkind: SonarScannerConfig\nspec:\n  rollout:\n    orgs: [platform]\n", []string{}},
+		{"rollout problems", "rollout:\n  percentage: 150%\n  orgs: platform\n", []string{
+			"2:15: invalid percentage '150%' for 'rollout.percentage', expected 0% to 100%",
+			"3:9: expected 'rollout.orgs' to be a list",
+		}},
+		{"unknown field", "verbsoe: true\n", []string{"1:1: unknown field 'verbsoe', expected one of: discover, feature, paths, properties, pullRequest, release, rollout, rules, skip, verbose"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, problem := range validateOrgDefaults([]byte(tt.content)) {
+				got = append(got, problem.String())
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_parseUserOverrides_strict(t *testing.T) {
+	_, err := parseUserOverrides([]byte("pullRequest:\n  stage: build\n  stpe: make\n"))
+	assert.EqualError(t, err, "3:3: unknown field 'pullRequest.stpe', expected one of: name, position, properties, stage, step")
+}
+
+func TestUserOverridesSchema(t *testing.T) {
+	published, err := ioutil.ReadFile("../../schema/jx-app-sonar-scanner.schema.json")
+	assert.NoError(t, err)
+	generated, err := UserOverridesSchema()
+	assert.NoError(t, err)
+	assert.Equal(t, string(generated), string(published), "regenerate with: sonar-scanner validate --print-schema > schema/jx-app-sonar-scanner.schema.json")
+}
@@ -2,27 +2,49 @@ package pipeline
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jenkins-x-apps/jx-app-sonar-scanner/internal/logging"
 	"github.com/jenkins-x-apps/jx-app-sonar-scanner/internal/util"
 	"github.com/jenkins-x-apps/jx-app-sonar-scanner/internal/version"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
-	yaml "gopkg.in/yaml.v2"
+	yaml "gopkg.in/yaml.v3"
 )
 
 const (
 	userOverridesFile string = ".jx-app-sonar-scanner.yaml"
+	sonarStepName     string = "sonar-scanner"
+	sonarStageName    string = "sonar"
+	backupSuffix      string = ".sonar-scanner.orig"
+)
+
+// Positions at which the scan can be inserted relative to the stage and step of a BuildStep
+const (
+	// PositionAfter inserts the scan directly after the named step, this is the default
+	PositionAfter = "after"
+	// PositionBefore inserts the scan directly before the named step
+	PositionBefore = "before"
+	// PositionFirstInStage inserts the scan as the first step of the named stage
+	PositionFirstInStage = "first-in-stage"
+	// PositionLastInStage inserts the scan as the last step of the named stage
+	PositionLastInStage = "last-in-stage"
+	// PositionNewStage inserts the scan in a stage of its own directly after the named stage
+	PositionNewStage = "new-stage"
 )
 
 var (
 	logger = logging.AppLogger().WithFields(log.Fields{"component": "meta-pipeline-extender"})
+
+	effectiveConfigPattern = regexp.MustCompile(`^jenkins-x(?:-(.+))?-effective\.yml$`)
 )
 
 // Patcher is responsible for injecting a new application step into the pipeline.
@@ -33,25 +55,121 @@ type Patcher struct {
 	apiKey        string
 	scanonpreview bool
 	scanonrelease bool
+	scanonfeature bool
 	debug         bool
+	// discover is set when anchors missing from the build pack are looked for among the steps
+	discover    bool
+	dryRun      bool
+	allContexts bool
+	output      string
+	out         io.Writer
+	env         func(string) string
+	decisions   []*Decision
+	// skipPullRequest holds the reason for leaving pull request pipelines unscanned, if there is one
+	skipPullRequest string
+	// orgDefaults is the file holding the org-wide defaults of the user overrides
+	orgDefaults string
+	// policy is the file holding the org policy restricting the user overrides
+	policy string
+	// optionProvenance records where the options the patcher was created with came from
+	optionProvenance Provenance
+	// buildPacksFile holds build packs merged over the built-in ones
+	buildPacksFile string
+	buildPacks     BuildPacks
+	// detection is the build pack guessed from the source tree, once detected is set
+	detected  bool
+	detection *Detection
+	// looseMatch is set when the user overrides are in the unversioned format, whose plain stage and step
+	// names earlier releases matched loosely
+	looseMatch bool
+	// newStages holds the last scan stage inserted after each anchor stage, so that scans keep their order
+	newStages map[*Stage]*Stage
+	now       func() time.Time
 }
 
 // UserOverrides represents a user supplied set of UserOverrides values
 type UserOverrides struct {
-	Verbose     bool      `yaml:"verbose,omitempty"`
-	Skip        bool      `yaml:"skip,omitempty"`
-	PullRequest BuildStep `yaml:"pullRequest,omitempty"`
-	Release     BuildStep `yaml:"release,omitempty"`
+	Verbose     bool       `yaml:"verbose,omitempty"`
+	Skip        Skip       `yaml:"skip,omitempty"`
+	PullRequest BuildSteps `yaml:"pullRequest,omitempty"`
+	Release     BuildSteps `yaml:"release,omitempty"`
+	Feature     BuildSteps `yaml:"feature,omitempty"`
+	Rules       SkipRules  `yaml:"rules,omitempty"`
+	Paths       PathFilter `yaml:"paths,omitempty"`
+	Rollout     Rollout    `yaml:"rollout,omitempty"`
+	// Discover looks for the anchor among the commands of the steps when neither the build pack nor the
+	// user overrides give one
+	Discover bool `yaml:"discover,omitempty"`
+	// Properties are SonarQube analysis properties added to those of the build pack for every pipeline
+	Properties map[string]string `yaml:"properties,omitempty"`
+}
+
+// BuildStep represents the stage and step at which we should insert the scan
+type BuildStep struct {
+	Stage    string `yaml:"stage,omitempty"`
+	Step     string `yaml:"step,omitempty"`
+	Position string `yaml:"position,omitempty"`
+	// Name names the scan step, each scan of a pipeline needs its own. It defaults to sonar-scanner.
+	Name string `yaml:"name,omitempty"`
+	// Properties are SonarQube analysis properties for this scan only
+	Properties map[string]string `yaml:"properties,omitempty"`
+}
+
+// BuildSteps lists the insertion points of the scans of one kind of pipeline. A single insertion point
+// may be given on its own rather than as a list.
+type BuildSteps []BuildStep
+
+// UnmarshalYAML reads either a single insertion point or a list of them
+func (b *BuildSteps) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.MappingNode {
+		step := BuildStep{}
+		err := node.Decode(&step)
+		if err != nil {
+			return err
+		}
+		*b = BuildSteps{step}
+		return nil
+	}
+	return node.Decode((*[]BuildStep)(b))
 }
 
-// BuildStep represents the stage and step after which we should insert the scan
-type BuildStep struct {
-	Stage string `yaml:"stage,omitempty"`
-	Step  string `yaml:"step,omitempty"`
+// needsStep tells whether the scan is placed relative to a step rather than to the stage as a whole
+func (b BuildStep) needsStep() bool {
+	return b.Position == "" || b.Position == PositionAfter || b.Position == PositionBefore
+}
+
+// complete tells whether the insertion point names a stage, and a step if it needs one
+func (b BuildStep) complete() bool {
+	return b.Stage != "" && (b.Step != "" || !b.needsStep())
+}
+
+func (b BuildStep) String() string {
+	if !b.needsStep() {
+		return fmt.Sprintf("%s stage '%s'", b.Position, b.Stage)
+	}
+	return fmt.Sprintf("%s step '%s' of stage '%s'", b.Position, b.Step, b.Stage)
+}
+
+// complete tells whether every insertion point of the list is complete
+func (b BuildSteps) complete() bool {
+	for _, step := range b {
+		if !step.complete() {
+			return false
+		}
+	}
+	return true
+}
+
+// scanName returns the name of the scan step inserted at this point
+func (b BuildStep) scanName() string {
+	if b.Name == "" {
+		return sonarStepName
+	}
+	return b.Name
 }
 
 // NewPatcher creates a new instance of Patcher.
-func NewPatcher(sourceDir string, context string, sqServer string, apiKey string, scanonpreview bool, scanonrelease bool) Patcher {
+func NewPatcher(sourceDir string, context string, sqServer string, apiKey string, scanonpreview bool, scanonrelease bool, scanonfeature bool) Patcher {
 	return Patcher{
 		sourceDir:     sourceDir,
 		context:       context,
@@ -59,7 +177,50 @@ func NewPatcher(sourceDir string, context string, sqServer string, apiKey string
 		apiKey:        apiKey,
 		scanonpreview: scanonpreview,
 		scanonrelease: scanonrelease,
+		scanonfeature: scanonfeature,
 		debug:         false,
+		output:        OutputText,
+		out:           os.Stdout,
+	}
+}
+
+// SetDryRun makes ConfigurePipeline print a unified diff of the changes instead of writing them.
+func (e *Patcher) SetDryRun(dryRun bool) {
+	e.dryRun = dryRun
+}
+
+// SetOrgDefaults sets the file holding the org-wide defaults, which the repository's own overrides and the
+// environment take precedence over. A missing file is ignored.
+func (e *Patcher) SetOrgDefaults(orgDefaults string) {
+	e.orgDefaults = orgDefaults
+}
+
+// SetPolicy sets the file holding the org policy, which restricts the settings a repository may override.
+// A missing file is ignored.
+func (e *Patcher) SetPolicy(policy string) {
+	e.policy = policy
+}
+
+// SetBuildPacks sets the file holding build packs to recognise on top of the built-in ones, or to replace
+// the anchors of built-in ones. A missing file is ignored.
+func (e *Patcher) SetBuildPacks(buildPacks string) {
+	e.buildPacksFile = buildPacks
+}
+
+// SetOptionProvenance records where the options the patcher was created with came from, so that they are
+// logged along with the effective settings.
+func (e *Patcher) SetOptionProvenance(provenance Provenance) {
+	e.optionProvenance = provenance
+}
+
+// SetOutput selects the format in which ConfigurePipeline reports its decisions, either OutputText or OutputJSON.
+func (e *Patcher) SetOutput(output string) error {
+	switch output {
+	case OutputText, OutputJSON:
+		e.output = output
+		return nil
+	default:
+		return errors.Errorf("unknown output format '%s'", output)
 	}
 }
 
@@ -75,12 +236,29 @@ func (e *Patcher) ConfigurePipeline() error {
 		return errors.Errorf("specified directory '%s' does not exist", e.sourceDir)
 	}
 
-	effectiveConfig := "jenkins-x-effective.yml"
-	if e.context != "" {
-		effectiveConfig = fmt.Sprintf("jenkins-x-%s-effective.yml", e.context)
+	var err error
+	e.buildPacks, err = loadBuildPacks(e.buildPacksFile)
+	if err != nil {
+		return err
+	}
+
+	contexts := []string{e.context}
+	if e.allContexts {
+		contexts, err = e.findContexts()
+		if err != nil {
+			return err
+		}
+	}
+
+	skip, reason, err := e.checkUserOverrides(userOverridesFile)
+	if err != nil {
+		return err
+	}
+	if skip {
+		return e.skip(contexts, reason)
 	}
 
-	userOverrides, err := e.getUserOverrides(userOverridesFile)
+	userOverrides, provenance, err := e.getUserOverrides(userOverridesFile)
 	if err != nil {
 		return errors.Wrap(err, "unable to get user Overrides")
 	}
@@ -89,567 +267,667 @@ func (e *Patcher) ConfigurePipeline() error {
 		e.debug = true
 		log.SetLevel(log.DebugLevel)
 	}
-	if userOverrides.Skip {
-		log.WithFields(log.Fields{
-			"sonarscanskip": true,
-		}).Warn("Skipping sonar scan due to developer UserOverrides")
-		return nil
+	e.discover = userOverrides.Discover
+	for name, source := range e.optionProvenance {
+		provenance[name] = source
 	}
-
-	pipelineConfigPath := filepath.Join(e.sourceDir, effectiveConfig)
-	if !util.Exists(pipelineConfigPath) {
-		return errors.Errorf("unable to find effective pipeline config in '%s'", e.sourceDir)
+	logProvenance(provenance)
+	skip, reason, err = e.applySkip(userOverrides.Skip)
+	if err != nil {
+		return err
+	}
+	if skip {
+		return e.skip(contexts, reason)
 	}
 
-	logger.Debugf("Pipeline config file: %s", pipelineConfigPath)
-
-	content, err := ioutil.ReadFile(pipelineConfigPath)
+	skip, reason, err = e.applyRollout(userOverrides.Rollout)
 	if err != nil {
-		return errors.Errorf("unable to open pipeline config '%s'", pipelineConfigPath)
+		return err
 	}
-
-	if e.debug {
-		dumpInput(content)
+	if skip {
+		return e.skip(contexts, reason)
 	}
 
-	lines := strings.Split(string(content), "\n")
-	lines = lines[:len(lines)-1] // trim the additional line introduced by strings.Split
-	if len(lines) == 0 {
-		return errors.Errorf("empty pipeline")
+	skip, reason, err = e.applySkipRules(userOverrides.Rules)
+	if err != nil {
+		return err
+	}
+	if skip {
+		return e.skip(contexts, reason)
 	}
 
 	if e.scanonpreview {
-		lines, err = e.insertApplicationStep(lines, "pullRequest", userOverrides)
-		if err != nil {
-			return errors.Wrap(err, "unable to enhance preview pipeline with sonar-scanner configuration")
+		skip, reason = e.applyPathFilter(userOverrides.Paths)
+		if skip {
+			e.skipPullRequest = reason
 		}
 	}
 
-	if e.scanonrelease {
-		lines, err = e.insertApplicationStep(lines, "release", userOverrides)
+	if !e.allContexts {
+		err = e.configureContext(userOverrides)
 		if err != nil {
-			return errors.Wrap(err, "unable to enhance release pipeline with sonar-scanner configuration")
+			return err
 		}
+		return e.report()
 	}
 
-	err = e.writeProjectConfig(lines, pipelineConfigPath)
+	failures := map[string]error{}
+	for _, context := range contexts {
+		e.context = context
+		err = e.configureContext(userOverrides)
+		if err != nil {
+			logger.Errorf("unable to configure %s: %s", effectiveConfigFile(context), err)
+			failures[context] = err
+		}
+	}
+	e.summarise(contexts, failures)
+	err = e.report()
 	if err != nil {
-		return errors.Wrap(err, "unable to write modified project config")
+		return err
 	}
-
-	if e.debug {
-		dumpOutput(pipelineConfigPath)
+	if len(failures) > 0 {
+		return errors.Errorf("unable to configure %d of %d pipeline contexts", len(failures), len(contexts))
 	}
 	return nil
 }
 
-// getUserOverrides returns a set of user defined properties if one exists in the source code
-func (e *Patcher) getUserOverrides(file string) (UserOverrides, error) {
-	userOverrides := UserOverrides{}
-	userOverridesFilePath := filepath.Join(e.sourceDir, file)
-	if util.Exists(userOverridesFilePath) {
-		// User has set local UserOverrides
-		userOverridesFileContent, err := ioutil.ReadFile(userOverridesFilePath)
-		if err != nil {
-			return userOverrides, errors.Errorf("failed to open '%s'", userOverridesFilePath)
-		}
-
-		err = yaml.Unmarshal(userOverridesFileContent, &userOverrides)
-		if err != nil {
-			return userOverrides, errors.Errorf("unable to parse '%s'", userOverridesFilePath)
+// skip records that no pipeline of any context is scanned
+func (e *Patcher) skip(contexts []string, reason string) error {
+	for _, context := range contexts {
+		e.context = context
+		for _, pipeline := range e.pipelines() {
+			e.decide(pipeline).Reason = reason
 		}
 	}
-	return userOverrides, nil
+	if e.allContexts {
+		e.summarise(contexts, map[string]error{})
+	}
+	return e.report()
 }
 
-// insertApplicationStep inserts a new step into the pipeline to trigger the scanner
-func (e *Patcher) insertApplicationStep(lines []string, pipeline string, userOverrides UserOverrides) ([]string, error) {
-
-	bpm := map[string]map[string]BuildStep{
-		"go":                     {"pullRequest": {Stage: "build", Step: "build-make-linux"}, "release": {Stage: "build", Step: "build-make-build"}},
-		"gradle":                 {"pullRequest": {Stage: "build", Step: "build-gradle-build"}, "release": {Stage: "build", Step: "build-gradle-build"}},
-		"javascript":             {"pullRequest": {Stage: "build", Step: "build-npm-test"}, "release": {Stage: "build", Step: "build-npm-test"}},
-		"maven":                  {"pullRequest": {Stage: "build", Step: "build-mvn-install"}, "release": {Stage: "build", Step: "build-mvn-deploy"}},
-		"ml-python-gpu-service":  {"pullRequest": {Stage: "build", Step: "build-testing"}, "release": {Stage: "build", Step: "build-testing"}},
-		"ml-python-gpu-training": {"pullRequest": {Stage: "build", Step: "testing"}, "release": {Stage: "build", Step: "flake8"}},
-		"ml-python-service":      {"pullRequest": {Stage: "build", Step: "build-testing"}, "release": {Stage: "build", Step: "build-testing"}},
-		"ml-python-training":     {"pullRequest": {Stage: "build", Step: "build-training"}, "release": {Stage: "build", Step: "build-training"}},
-		"python":                 {"pullRequest": {Stage: "build", Step: "build-python-unittest"}, "release": {Stage: "build", Step: "build-python-unittest"}},
-		"scala":                  {"pullRequest": {Stage: "build", Step: "build-sbt-assembly"}, "release": {Stage: "build", Step: "build-sbt-assembly"}},
-		"typescript":             {"pullRequest": {Stage: "build", Step: "build-npm-test"}, "release": {Stage: "build", Step: "build-npm-test"}},
-	}
-
-	buildPack := getBuildPack(lines)
-	logger.Infof("Detected buildpack %s\n", buildPack)
-
-	var stagename string
-	var stepname string
-	if pipeline == "pullRequest" && userOverrides.PullRequest.Stage != "" {
-		stagename = userOverrides.PullRequest.Stage
-		stepname = userOverrides.PullRequest.Step
-		logger.Infof("Overriding %s config\n", pipeline)
-	} else if pipeline == "release" && userOverrides.Release.Stage != "" {
-		stagename = userOverrides.Release.Stage
-		stepname = userOverrides.Release.Step
-		logger.Infof("Overriding %s config\n", pipeline)
-	} else {
-		stagename = bpm[buildPack][pipeline].Stage
-		stepname = bpm[buildPack][pipeline].Step
-	}
-	logger.Debugf("Looking for Stage: %s Step: %s\n", stagename, stepname)
+// SetAllContexts makes ConfigurePipeline patch the effective pipeline of every context found in the source
+// directory, rather than only the one named by the pipeline context. Each context then gets its own project key.
+func (e *Patcher) SetAllContexts(allContexts bool) {
+	e.allContexts = allContexts
+}
 
-	if buildPack == "" || stagename == "" || stepname == "" {
-		// We have found a pipeline that lacks a buildPack that we recognise
-		// Fail without breaking the build
-		log.Warnf("unable to recognise buildPack: %s\n", buildPack)
-		log.Warnf("skipping scan on pipeline: %s [1]\n", pipeline)
-		return lines, nil
+// effectiveConfigFile returns the name of the effective pipeline of a context, "" being the default context
+func effectiveConfigFile(context string) string {
+	if context == "" {
+		return "jenkins-x-effective.yml"
 	}
+	return fmt.Sprintf("jenkins-x-%s-effective.yml", context)
+}
 
-	logger.Infof("build: %s", pipeline)
-
-	// Identify the subset of this configuration that represents the desired pipeline
-	targetPipelineStart, err := indexOfNamedPipeline(lines, pipeline)
+// findContexts returns the contexts of all effective pipelines in the source directory
+func (e *Patcher) findContexts() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(e.sourceDir, "jenkins-x*-effective.yml"))
 	if err != nil {
-		return nil, errors.Wrap(err, "finding pipeline")
+		return nil, errors.Wrapf(err, "unable to search '%s' for effective pipeline configs", e.sourceDir)
 	}
-
-	pipelineIndent := countLeadingSpace(lines[targetPipelineStart])
-	targetPipelineEnd, err := indexOfEndOfPipeline(lines, targetPipelineStart+1, pipelineIndent)
-	if err != nil {
-		return nil, errors.Wrap(err, "finding end of pipeline")
+	contexts := []string{}
+	for _, file := range files {
+		match := effectiveConfigPattern.FindStringSubmatch(filepath.Base(file))
+		if match == nil {
+			continue
+		}
+		contexts = append(contexts, match[1])
 	}
+	if len(contexts) == 0 {
+		return nil, errors.Errorf("unable to find effective pipeline config in '%s'", e.sourceDir)
+	}
+	logger.Debugf("Found pipeline contexts: %v", contexts)
+	return contexts, nil
+}
 
-	logger.Debugf("targetPipelineStart: %d - %s\n", targetPipelineStart, lines[targetPipelineStart])
-	logger.Debugf("targetPipelineEnd: %d - %s\n", targetPipelineEnd, lines[targetPipelineEnd])
-	logger.Debugf("size: %d\n", len(lines))
+// configureContext patches the effective pipeline of the current context
+func (e *Patcher) configureContext(userOverrides UserOverrides) error {
+	effectiveConfig := effectiveConfigFile(e.context)
+	pipelineConfigPath := filepath.Join(e.sourceDir, effectiveConfig)
+	if !util.Exists(pipelineConfigPath) {
+		return errors.Errorf("unable to find effective pipeline config in '%s'", e.sourceDir)
+	}
 
-	targetPipeline := lines[targetPipelineStart : targetPipelineEnd+1] // This creates an offset that we need to account for later
+	logger.Debugf("Pipeline config file: %s", pipelineConfigPath)
 
-	// Identify the point where we should insert environment variables
-	createEnv := false
-	envInsertPoint, err := indexOfEnv(targetPipeline)
+	content, err := ioutil.ReadFile(pipelineConfigPath)
 	if err != nil {
-		// No env section in containerOptions: so insert in pipelineConfig:
-		pipelineConfigStart, err2 := indexOfPipelineConfig(lines)
-		if err2 != nil {
-			return nil, errors.Wrap(err, "finding pipelineConfig")
-		}
-		logger.Debugf("pipelineConfigStart: %d - %s\n", pipelineConfigStart, lines[pipelineConfigStart])
-		pipelinesStart, err3 := indexOfPipelines(lines)
-		if err3 != nil {
-			return nil, errors.Wrap(err, "finding pipelines")
-		}
-		logger.Debugf("pipelinesStart: %d - %s\n", pipelinesStart, lines[pipelinesStart])
-		indexEnv, err4 := indexOfEnv(lines[:pipelinesStart])
-		if err4 != nil {
-			// No existing env: section in pipelineConfig either
-			envInsertPoint = pipelineConfigStart + 1
-			createEnv = true
-		} else {
-			envInsertPoint = indexEnv + 1
-		}
-	} else {
-		envInsertPoint = targetPipelineStart + envInsertPoint + 1
+		return errors.Errorf("unable to open pipeline config '%s'", pipelineConfigPath)
 	}
 
-	// Identify the subset of this configuration that represents the desired stage
-	targetStagesStart, err := indexOfStages(lines[targetPipelineStart : targetPipelineEnd+1])
-	if err != nil {
-		return nil, errors.Wrap(err, "finding stages:")
-	}
-	targetStagesStart = targetStagesStart + targetPipelineStart
-	logger.Debugf("targetStagesStart: %d - %s\n", targetStagesStart, lines[targetStagesStart])
-	somewhereInTargetStage, err := indexOfNamedStage(lines[targetStagesStart:targetPipelineEnd+1], stagename)
-	if err != nil {
-		// We have found a pipeline that lacks a build stage that we recognise
-		// Fail without breaking the build
-		logger.Debugf("unable to find named Stage: %s\n", stagename)
-		logger.Debugf("skipping scan on pipeline: %s [2]\n", pipeline)
-		return lines, nil
+	if e.debug {
+		dumpInput(content)
 	}
-	somewhereInTargetStage = somewhereInTargetStage + targetStagesStart // realign to absolute offset
 
-	// scan from next line after name: until we find the start of the next steps: object
-	currentStage, err := indexOfCurrentStage(lines, somewhereInTargetStage)
+	config, err := ParseProjectConfig(content)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to find start of stage")
+		return errors.Wrapf(err, "unable to parse pipeline config '%s'", pipelineConfigPath)
 	}
-	logger.Debugf("currentStage: %d - %s\n", currentStage, lines[currentStage])
-	targetStepsStart, err := indexOfNextSteps(lines[currentStage : targetPipelineEnd+1])
-	if err != nil {
-		return nil, errors.Wrap(err, "unable to find steps:")
-	}
-	targetStepsStart = targetStepsStart + currentStage // realign to absolute offset
-	logger.Debugf("targetStepsStart: %d - %s\n", targetStepsStart, lines[targetStepsStart])
 
-	// find end of steps: section
-	targetStepsEnd, err := indexOfEndOfSteps(lines[:targetPipelineEnd+1], targetStepsStart, countLeadingSpace(lines[targetStepsStart]))
-	if err != nil {
-		return nil, errors.Wrap(err, "unable to find end of steps:")
+	if e.scanonpreview && e.skipPullRequest != "" {
+		e.decide("pullRequest").Reason = e.skipPullRequest
+	} else if e.scanonpreview {
+		err = e.insertApplicationStep(config, "pullRequest", userOverrides)
+		if err != nil {
+			return errors.Wrap(err, "unable to enhance preview pipeline with sonar-scanner configuration")
+		}
 	}
-	logger.Debugf("targetStepsEnd: %d - %s\n", targetStepsEnd, lines[targetStepsEnd])
 
-	targetSteps := lines[targetStepsStart : targetStepsEnd+1] // This creates an offset that we need to account for later
+	if e.scanonrelease {
+		err = e.insertApplicationStep(config, "release", userOverrides)
+		if err != nil {
+			return errors.Wrap(err, "unable to enhance release pipeline with sonar-scanner configuration")
+		}
+	}
 
-	// Identify the line relating to the step we wish to insert after
+	if e.scanonfeature {
+		err = e.insertApplicationStep(config, "feature", userOverrides)
+		if err != nil {
+			return errors.Wrap(err, "unable to enhance feature pipeline with sonar-scanner configuration")
+		}
+	}
 
-	somewhereInTargetStep, err := indexOfNamedStep(targetSteps, stepname)
+	patched, err := config.Bytes()
 	if err != nil {
-		// We have found a pipeline that lacks a build step that we recognise
-		// Fail without breaking the build
-		logger.Debugf("unable to find named Step: %s\n", stepname)
-		logger.Debugf("skipping scan on pipeline: %s [3]\n", pipeline)
-		return lines, nil
+		return errors.Wrap(err, "unable to serialise modified project config")
 	}
-	somewhereInTargetStep = somewhereInTargetStep + targetStepsStart // realign to absolute offset
 
-	logger.Debugf("somewhereInTargetStep: %d - %s\n", somewhereInTargetStep, lines[somewhereInTargetStep])
+	if e.output == OutputJSON {
+		err = e.locateDecisions(patched)
+		if err != nil {
+			return err
+		}
+	}
 
-	// scan from next line after name: until we find the start of the next step
-	nextStep, err := indexOfNextStep(lines[somewhereInTargetStep+1 : targetPipelineEnd+1])
-	if err != nil {
-		return nil, errors.Wrap(err, "unable to find next step")
+	if e.dryRun {
+		logger.Infof("Dry run, leaving '%s' unchanged", pipelineConfigPath)
+		if e.output == OutputText {
+			err = writeDiff(e.out, effectiveConfig, content, patched)
+			if err != nil {
+				return errors.Wrap(err, "unable to show changes to project config")
+			}
+		}
+		return nil
 	}
-	nextStep = nextStep + somewhereInTargetStep // realign to absolute offset
 
-	currentStep, err := indexOfCurrentStep(lines, somewhereInTargetStep)
+	err = e.writeProjectConfig(patched, pipelineConfigPath)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to find start of step")
+		return errors.Wrap(err, "unable to write modified project config")
 	}
-	stepIndent := countLeadingSpace(lines[currentStep])
-	envIndent := countLeadingSpace(lines[envInsertPoint])
-	logger.Debugf("nextStep: %d - %s\n", nextStep, lines[nextStep])
-
-	// resolve the offsets
-	absoluteInsertPoint := nextStep + 1
-
-	logger.Debugf("absoluteInsertPoint: %d\n", absoluteInsertPoint)
 
-	applicationStep := e.createApplicationStep(stepIndent)
+	if e.debug {
+		dumpOutput(pipelineConfigPath)
+	}
+	return nil
+}
 
-	lines = append(lines, applicationStep...)                                           // make the slice bigger by the size of the new step
-	copy(lines[absoluteInsertPoint+len(applicationStep):], lines[absoluteInsertPoint:]) // move the subsequent lines down
-	copy(lines[absoluteInsertPoint:], applicationStep)                                  // insert the new step
+// pipelines returns the kinds of pipeline that should be scanned
+func (e *Patcher) pipelines() []string {
+	pipelines := []string{}
+	if e.scanonpreview {
+		pipelines = append(pipelines, "pullRequest")
+	}
+	if e.scanonrelease {
+		pipelines = append(pipelines, "release")
+	}
+	if e.scanonfeature {
+		pipelines = append(pipelines, "feature")
+	}
+	return pipelines
+}
 
-	if !envExists(lines, envInsertPoint) {
-		envEntry := e.createEnvEntry(envIndent, buildPack, createEnv)
-		lines = append(lines, envEntry...)                                 // make the slice bigger by the size of the environment variables
-		copy(lines[envInsertPoint+len(envEntry):], lines[envInsertPoint:]) // move the subsequent lines down
-		copy(lines[envInsertPoint:], envEntry)                             // insert the new step
+// report prints the insertion decisions when they have been asked for
+func (e *Patcher) report() error {
+	if e.output != OutputJSON {
+		return nil
 	}
-	return lines, nil
+	return writeDecisions(e.out, e.decisions)
 }
 
-func (e *Patcher) writeProjectConfig(lines []string, pipelineConfigPath string) error {
-	err := util.MoveFile(pipelineConfigPath, pipelineConfigPath+".sonar-scanner.orig")
-	if err != nil {
-		return errors.Wrapf(err, "unable to backup '%s'", pipelineConfigPath)
+// buildSteps returns the user supplied insertion points for the given kind of pipeline
+func (u UserOverrides) buildSteps(pipeline string) BuildSteps {
+	switch pipeline {
+	case "pullRequest":
+		return u.PullRequest
+	case "release":
+		return u.Release
+	case "feature":
+		return u.Feature
+	default:
+		return nil
 	}
+}
 
-	logger.Debugf("writing '%s'", pipelineConfigPath)
+// insertApplicationStep inserts a new step into the pipeline to trigger the scanner
+func (e *Patcher) insertApplicationStep(config *ProjectConfig, pipeline string, userOverrides UserOverrides) error {
 
-	file, err := os.OpenFile(pipelineConfigPath, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		return errors.Wrapf(err, "unable to create new pipeline file '%s'", pipelineConfigPath)
+	buildPack := e.resolveBuildPack(config)
+	logger.Infof("Detected buildpack %s\n", buildPack.Name)
+
+	scans := userOverrides.buildSteps(pipeline)
+	if len(scans) == 0 {
+		scans = BuildSteps{{}}
+	}
+	names := map[string]bool{}
+	for _, scan := range scans {
+		if names[scan.scanName()] {
+			return errors.Errorf("scan name '%s' is used more than once in %s pipelines, give each scan its own name", scan.scanName(), pipeline)
+		}
+		names[scan.scanName()] = true
 	}
-	defer file.Close()
-	sep := "\n"
-	for _, line := range lines {
-		if _, err = file.WriteString(line + sep); err != nil {
-			return errors.Wrapf(err, "unable to write '%s'", pipelineConfigPath)
+
+	for _, scan := range scans {
+		err := e.insertScan(config, pipeline, buildPack, scan, userOverrides.properties(scan), len(scans) > 1)
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func (e *Patcher) createApplicationStep(indent int) []string {
-	// set correct whitespace for indent
-	ws := nspaces(indent)
+// insertScan inserts one scan into the pipeline, at the anchor given by the user overrides or else at the
+// first of the anchors of the build pack found in the pipeline. When the pipeline has several scans, an
+// existing scan is only updated if it has the same name.
+func (e *Patcher) insertScan(config *ProjectConfig, pipeline string, buildPack BuildPack, scan BuildStep, properties map[string]string, several bool) error {
+	decision := e.decide(pipeline)
+	decision.Detection = buildPack.detection
+	name := scan.scanName()
+	if name != sonarStepName {
+		decision.Scan = name
+	}
 
-	// build the set of arguments for the script
-	args := []string{}
-	if e.sqServer != "" {
-		args = append(args, "-s "+e.sqServer)
+	anchors := BuildSteps{scan}
+	if scan.Stage != "" {
+		logger.Infof("Overriding %s config\n", pipeline)
+	} else {
+		anchors = buildPack.anchors(pipeline)
 	}
-	if e.apiKey != "" {
-		args = append(args, "-k "+e.apiKey)
+	candidates := BuildSteps{}
+	for _, candidate := range anchors {
+		if candidate.Position == "" {
+			candidate.Position = PositionAfter
+		}
+		switch candidate.Position {
+		case PositionAfter, PositionBefore, PositionFirstInStage, PositionLastInStage, PositionNewStage:
+		default:
+			return errors.Errorf("unknown position '%s' for pipeline '%s'", candidate.Position, pipeline)
+		}
+		candidates = append(candidates, candidate)
 	}
-	args = append(args, "-r "+strconv.FormatBool(e.scanonrelease))
-	args = append(args, "-p "+strconv.FormatBool(e.scanonpreview))
-	if e.debug {
-		args = append(args, "-v "+strconv.FormatBool(e.debug))
+	if len(candidates) > 0 {
+		decision.describeAnchor(candidates[0], nil, nil)
 	}
 
-	// construct the pipeline syntax for the step
-	step := []string{}
-	step = append(step, ws+"- command: /usr/local/bin/exec-sonar-scanner.sh")
-	step = append(step, ws+"  args:")
-	for _, arg := range args {
-		step = append(step, ws+"  - "+arg)
+	// Without an anchor from the build pack or the user overrides, look for one among the steps if asked to
+	discover := e.discover && (len(candidates) == 0 || !candidates.complete())
+	if !discover && (buildPack.Name == "" || len(candidates) == 0 || !candidates.complete()) {
+		// We have found a pipeline that lacks a buildPack that we recognise
+		// Fail without breaking the build
+		log.Warnf("unable to recognise buildPack: %s\n", buildPack.Name)
+		log.Warnf("skipping scan on pipeline: %s [1]\n", pipeline)
+		decision.Reason = fmt.Sprintf("no anchor for buildPack '%s'", buildPack.Name)
+		return nil
 	}
-	step = append(step, ws+"  image: "+version.GetFQImage())
-	step = append(step, ws+"  name: sonar-scanner")
-	return step
-}
 
-func (e *Patcher) createEnvEntry(indent int, buildPack string, create bool) []string {
-	// set correct whitespace for indent
-	ws := nspaces(indent)
+	logger.Infof("build: %s", pipeline)
 
-	// construct the pipeline syntax for the environment variable
-	env := []string{}
-	if create {
-		env = append(env, ws+"env:")
+	// Identify the subset of this configuration that represents the desired pipeline
+	if config.PipelineConfig == nil {
+		return errors.Errorf("finding pipelineConfig")
+	}
+	targetPipeline := config.Pipeline(pipeline)
+	if targetPipeline == nil {
+		return errors.Errorf("finding pipeline '%s'", pipeline)
 	}
-	env = append(env, ws+"- name: BUILDPACK_NAME")
-	env = append(env, ws+"  value: "+buildPack)
-	return env
-}
 
-func nspaces(n int) string {
-	s := make([]byte, n)
-	for i := 0; i < n; i++ {
-		s[i] = ' '
+	// Identify the stage and the step we wish to insert after
+	if !targetPipeline.HasStages() {
+		return errors.Errorf("finding stages: in pipeline '%s'", pipeline)
 	}
-	return string(s)
-}
 
-// indexOfNamedStage finds the first instance of a named stage with the given pipeline
-func indexOfNamedStage(lines []string, name string) (int, error) {
-	stageIndent := countLeadingSpace(lines[0])
-	for l, line := range lines {
-		isTopLevel, err := hasMatchingIndent(line, stageIndent)
-		if err != nil {
-			return 0, errors.Wrapf(err, "parsing match: '%s'", line)
+	// Update a scan left by an earlier run, or written by hand, rather than adding another one
+	existing := findScannerSteps(targetPipeline)
+	if several {
+		existing = stepsNamed(existing, name)
+	}
+	if len(existing) > 0 {
+		*decision = Decision{Context: e.context, Pipeline: pipeline, Action: ActionUpdate, Scan: decision.Scan, Step: existing[0].Name, StepLine: existing[0].Line(), Detection: decision.Detection}
+		for _, step := range existing {
+			logger.Infof("Updating existing %s step '%s' on line %d\n", sonarStepName, step.Name, step.Line())
+			application := e.createApplicationStep(name, properties, buildPack.template())
+			step.SetArgs(application.Args)
+			step.SetImage(application.Image)
 		}
-		isFirstIndent, err := hasMatchingIndent(line, stageIndent+2)
+		return e.addBuildPackName(config, targetPipeline, buildPack.Name)
+	}
+
+	var anchor BuildStep
+	var targetStage *Stage
+	var targetStep *Step
+	var err error
+	if !discover {
+		anchor, targetStage, targetStep, err = findAnchor(targetPipeline, candidates, e.looseMatch && scan.Stage != "", decision)
 		if err != nil {
-			return 0, errors.Wrapf(err, "parsing match: '%s'", line)
+			return err
 		}
-		if isTopLevel || isFirstIndent {
-			if isNamedStage(line, name) {
-				return l, nil
-			}
+		// The anchors of a build pack detected from the source tree are rarely in a pipeline written without one
+		if targetStage == nil && e.discover {
+			logger.Infof("No anchor of buildPack %s found in %s pipeline, looking for one among the steps", buildPack.Name, pipeline)
+			discover = true
 		}
 	}
-	return 0, errors.Errorf("unable to find stage '%s'", name)
-}
-
-// indexOfNamedStep finds the first instance of a named step with the given stage
-func indexOfNamedStep(lines []string, stepname string) (int, error) {
-	for l, line := range lines {
-		if strings.Contains(line, stepname) && strings.Contains(line, "name:") {
-			return l, nil
+	if discover {
+		return e.insertDiscoveredScan(config, targetPipeline, buildPack, name, properties, decision)
+	}
+	if targetStage == nil {
+		// We have found a pipeline that lacks the stage or step of every anchor that we recognise
+		// Fail without breaking the build
+		tried := []string{}
+		for _, candidate := range candidates {
+			tried = append(tried, candidate.String())
 		}
+		logger.WithFields(log.Fields{"sonarscananchor": "missing", "pipeline": pipeline, "buildPack": buildPack.Name}).
+			Warnf("Skipping scan on %s pipeline: %s. Tried %s. Set the anchor in %s or in the build pack registry.", pipeline, decision.Reason, strings.Join(tried, ", "), userOverridesFile)
+		return nil
+	}
+	if len(candidates) > 1 {
+		logger.Infof("Anchoring the scan of %s pipeline %s", pipeline, anchor)
 	}
-	return 0, errors.Errorf("unable to find step '%s'", stepname)
-}
 
-// indexOfNamedPipeline finds the first instance of a named pipeline
-func indexOfNamedPipeline(lines []string, pipeline string) (int, error) {
-	for l, line := range lines {
-		if strings.Contains(line, pipeline+":") {
-			return l, nil
+	application := e.createApplicationStep(name, properties, buildPack.template())
+	switch anchor.Position {
+	case PositionNewStage:
+		stageName := sonarStageName
+		if name != sonarStepName {
+			stageName = name
+		}
+		if util.Contains(stageNames(targetPipeline), stageName) {
+			return errors.Errorf("unable to insert stage '%s' for scan '%s' in %s pipeline, a stage of that name exists, give the scan another name", stageName, name, pipeline)
+		}
+		after := targetStage
+		if previous, ok := e.newStages[targetStage]; ok {
+			after = previous
+		}
+		stage := NewStage(stageName, application)
+		err := targetPipeline.InsertStageAfter(after, stage)
+		if err != nil {
+			return errors.Wrap(err, "unable to insert sonar stage")
+		}
+		if e.newStages == nil {
+			e.newStages = map[*Stage]*Stage{}
+		}
+		e.newStages[targetStage] = stage
+	case PositionFirstInStage, PositionLastInStage:
+		index := 0
+		if anchor.Position == PositionLastInStage {
+			index = len(targetStage.Steps)
 		}
+		targetStage.InsertStep(index, application)
+	default:
+		index := targetStage.IndexOfStep(targetStep)
+		if anchor.Position == PositionAfter {
+			index++
+		}
+		targetStage.InsertStep(index, application)
 	}
-	return 0, errors.Errorf("unable to find pipeline '%s'", pipeline)
-}
+	decision.Action = ActionInsert
 
-// isRootOfSection indicates whether a given string s is the root of a section
-func isRootOfSection(s string) (bool, error) {
-	exp := `^\s+-\s\S+:`
-	return regexp.MatchString(exp, s)
+	return e.addBuildPackName(config, targetPipeline, buildPack.Name)
 }
 
-// indexOfString finds the first instance of the given string in a slice
-func indexOfString(lines []string, s string) (int, error) {
-	for l, line := range lines {
-		if strings.Contains(line, s) {
-			return l, nil
+// findAnchor returns the first of the candidate anchors whose stage, and step if it needs one, are in the
+// pipeline. With loose, a plain name that matches nothing exactly selects the single stage or step whose name
+// contains it, as in earlier releases. The decision records the anchor found, or else the first candidate and
+// why no anchor was found.
+func findAnchor(targetPipeline *ParsedPipeline, candidates BuildSteps, loose bool, decision *Decision) (BuildStep, *Stage, *Step, error) {
+	missing := []string{}
+	for i, candidate := range candidates {
+		logger.Debugf("Looking for Stage: %s Step: %s Position: %s\n", candidate.Stage, candidate.Step, candidate.Position)
+		stageSelector, err := newStageSelector(candidate.Stage)
+		if err != nil {
+			return candidate, nil, nil, errors.Wrapf(err, "invalid stage selector for pipeline '%s'", decision.Pipeline)
 		}
-	}
-	return 0, errors.Errorf("unable to find '%s'", s)
-}
-
-// indexOfNextStep returns the index of the first line of a new steps: object
-func indexOfNextStep(lines []string) (int, error) {
-	for l, line := range lines {
-		match, err := isRootOfSection(line)
+		targetStage, err := findStage(targetPipeline, stageSelector)
 		if err != nil {
-			return 0, errors.Wrapf(err, "finding next Step: '%s'", line)
+			return candidate, nil, nil, err
 		}
-		if match {
-			return l, nil
+		if targetStage == nil && loose {
+			if targetStage = findStageLoosely(targetPipeline, candidate.Stage); targetStage != nil {
+				warnLooseMatch(decision.Pipeline, "stage", candidate.Stage, targetStage.Name)
+			}
 		}
-	}
-	return len(lines), nil
-}
-
-// indexOfNextSteps returns the index of the first line of a new step or the end of the list
-func indexOfNextSteps(lines []string) (int, error) {
-	for l, line := range lines {
-		if strings.Contains(line, "steps:") {
-			return l, nil
+		if targetStage == nil {
+			missing = append(missing, fmt.Sprintf("stage '%s'", candidate.Stage))
+			if hint := legacySuggestion(candidate.Stage, stageNames(targetPipeline)); hint != "" {
+				missing[len(missing)-1] += " (" + hint + ")"
+			}
+			continue
+		}
+		logger.Debugf("targetStage: line %d\n", targetStage.Line())
+		if i == 0 {
+			decision.StageLine = targetStage.Line()
+		}
+		if candidate.Position == PositionNewStage {
+			decision.describeAnchor(candidate, targetStage, nil)
+			return candidate, targetStage, nil, nil
 		}
-	}
-	return 0, errors.Errorf("unable to find steps:")
-}
 
-// indexOfCurrentSection returns the index of the first line of the section containing this index
-func indexOfCurrentSection(lines []string, start int) (int, error) {
-	for l := start; l > 0; l-- {
-		match, err := isRootOfSection(lines[l])
+		if !targetStage.HasSteps() {
+			return candidate, nil, nil, errors.Errorf("unable to find steps: in stage '%s'", candidate.Stage)
+		}
+		if !candidate.needsStep() {
+			decision.describeAnchor(candidate, targetStage, nil)
+			return candidate, targetStage, nil, nil
+		}
+		stepSelector, err := newSelector(candidate.Step)
+		if err != nil {
+			return candidate, nil, nil, errors.Wrapf(err, "invalid step selector for pipeline '%s'", decision.Pipeline)
+		}
+		targetStep, err := findStep(targetStage.Steps, stepSelector)
 		if err != nil {
-			return 0, errors.Wrapf(err, "checking root status of line: '%s'", lines[l])
+			return candidate, nil, nil, err
 		}
-		if match {
-			return l, nil
+		if targetStep == nil && loose {
+			if targetStep = findStepLoosely(targetStage.Steps, candidate.Step); targetStep != nil {
+				warnLooseMatch(decision.Pipeline, "step", candidate.Step, targetStep.Name)
+			}
 		}
+		if targetStep == nil {
+			missing = append(missing, fmt.Sprintf("step '%s'", candidate.Step))
+			if hint := legacySuggestion(candidate.Step, stepNames(targetStage.Steps)); hint != "" {
+				missing[len(missing)-1] += " (" + hint + ")"
+			}
+			continue
+		}
+		logger.Debugf("targetStep: line %d\n", targetStep.Line())
+		decision.describeAnchor(candidate, targetStage, targetStep)
+		return candidate, targetStage, targetStep, nil
 	}
-	return 0, errors.Errorf("unable to find start of step containing '%d'", start)
-}
-
-// indexOfCurrentStage returns the index of the first line of the stage containing this index
-func indexOfCurrentStage(lines []string, start int) (int, error) {
-	return indexOfCurrentSection(lines, start)
-}
-
-// indexOfCurrentStep returns the index of the first line of the step containing this index
-func indexOfCurrentStep(lines []string, start int) (int, error) {
-	return indexOfCurrentSection(lines, start)
+	if len(missing) == 1 {
+		decision.Reason = "unable to find " + missing[0]
+	} else {
+		decision.Reason = "unable to find any of " + strings.Join(missing, ", ")
+	}
+	return BuildStep{}, nil, nil, nil
 }
 
-// hasMatchingIndent indicates whether a given string s has an initial indent of length i
-func hasMatchingIndent(s string, i int) (bool, error) {
-	exp := `^\s{` + strconv.Itoa(i) + `}\S`
-	return regexp.MatchString(exp, s)
+// warnLooseMatch warns that an anchor was only found by the deprecated loose matching of unversioned files
+func warnLooseMatch(pipeline string, kind string, expr string, name string) {
+	logger.WithFields(log.Fields{"pipeline": pipeline, kind: expr, "matched": name}).
+		Warnf("%s: %s '%s' selects '%s' by the loose matching of earlier releases, which is deprecated. Set %s: %s, as names are matched exactly once %s is migrated to %s.",
+			pipeline, kind, expr, name, kind, name, userOverridesFile, UserOverridesAPIVersion)
 }
 
-// indexOfEndOfPipeline finds the index of the last entry in the current pipeline, or the end of the file if no subsequent pipeline is defined
-func indexOfEndOfPipeline(lines []string, start int, indent int) (int, error) {
-	if start >= len(lines) {
-		return 0, errors.Errorf("start value too big '%d' [1]", start)
-	}
-	for i := start; i < len(lines); i++ {
-		match, err := hasMatchingIndent(lines[i], indent)
+// addBuildPackName makes the buildpack name available to the scanner through the environment of the pipeline
+func (e *Patcher) addBuildPackName(config *ProjectConfig, targetPipeline *ParsedPipeline, buildPack string) error {
+	// Identify the env: section to which the buildpack name should be added
+	env := targetPipeline.EnvVars()
+	if env == nil {
+		// No env section in the pipeline: so insert in pipelineConfig:
+		var err error
+		env, err = config.PipelineConfig.EnsureEnv()
 		if err != nil {
-			return 0, errors.Wrapf(err, "whilst parsing line: '%s'", lines[i])
-		}
-		if match {
-			return i - 1, nil // report the index of the previous line
+			return err
 		}
 	}
-	// end of file
-	return len(lines) - 2, nil // account for last line being blank
-}
+	logger.Debugf("env: line %d\n", env.Line())
 
-// indexOfEndOfSteps finds the index of the last entry in the current steps:, or the end of the list
-func indexOfEndOfSteps(lines []string, start int, indent int) (int, error) {
-	if start >= len(lines) {
-		return 0, errors.Errorf("start value too big '%d' [2]", start)
+	if env.Get("BUILDPACK_NAME") == nil {
+		env.Insert(0, "BUILDPACK_NAME", buildPack)
 	}
-	for i := start; i < len(lines); i++ {
-		thisindent := countLeadingSpace(lines[i])
-		if thisindent < indent {
-			return i - 1, nil // report the index of the previous line
-		}
-	}
-	// end of file
-	return len(lines) - 1, nil
+	return nil
 }
 
-// indexOfEndOfStage finds the index of the last entry in the current stage, or the end of the list if no subsequent stage is defined
-func indexOfEndOfStage(lines []string, start int, indent int) (int, error) {
-	if start >= len(lines) {
-		return 0, errors.Errorf("start value too big '%d' [3]", start)
-	}
-	for i := start; i < len(lines); i++ {
-		match, err := hasMatchingIndent(lines[i], indent)
-		if err != nil {
-			return 0, errors.Wrapf(err, "whilst parsing line: '%s'", lines[i])
-		}
-		if match {
-			return i - 1, nil // report the index of the previous line
+// findScannerSteps returns the steps of the pipeline that already run the scanner, identified either by
+// their name or by their image
+func findScannerSteps(targetPipeline *ParsedPipeline) []*Step {
+	steps := []*Step{}
+	targetPipeline.WalkStages(func(stage *Stage, parents []*Stage) bool {
+		for _, step := range stage.Steps {
+			if step.Name == sonarStepName || imageName(step.Image) == version.GetImageName() {
+				steps = append(steps, step)
+			}
 		}
-	}
-	// end of file
-	return len(lines) - 1, nil
+		return true
+	})
+	return steps
 }
 
-// countLeadingSpace measures the indent of the given string
-func countLeadingSpace(line string) int {
-	i := 0
-	for _, runeValue := range line {
-		if runeValue == ' ' {
-			i++
-		} else {
-			break
+// stepsNamed returns the steps with the given name
+func stepsNamed(steps []*Step, name string) []*Step {
+	named := []*Step{}
+	for _, step := range steps {
+		if step.Name == name {
+			named = append(named, step)
 		}
 	}
-	return i
+	return named
 }
 
-func getBuildPack(lines []string) string {
-	exp := `^buildPack: (\S+)`
-	re := regexp.MustCompile(exp)
-	r := re.FindStringSubmatch(lines[0])
-	if len(r) == 2 {
-		return r[1]
+// imageName strips the tag or digest from an image reference
+func imageName(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
 	}
-	return ""
+	return image
 }
 
-// indexOfEnv finds the first instance of an env: entry
-func indexOfEnv(lines []string) (int, error) {
-	return indexOfString(lines, "env:")
-}
+// writeProjectConfig replaces the effective pipeline with content, keeping a backup of the original.
+// The original is left untouched unless the new content has been written and parses.
+func (e *Patcher) writeProjectConfig(content []byte, pipelineConfigPath string) error {
+	// Only the first backup holds the pipeline as jx generated it, so never replace it
+	backupPath := pipelineConfigPath + backupSuffix
+	if util.Exists(backupPath) {
+		logger.Debugf("keeping existing backup '%s'", backupPath)
+	} else {
+		err := util.CopyFile(pipelineConfigPath, backupPath)
+		if err != nil {
+			return errors.Wrapf(err, "unable to backup '%s'", pipelineConfigPath)
+		}
+	}
 
-// indexOfPipelineConfig finds the start of the pipelineConfig: entry
-func indexOfPipelineConfig(lines []string) (int, error) {
-	return indexOfString(lines, "pipelineConfig:")
-}
+	logger.Debugf("writing '%s'", pipelineConfigPath)
 
-// indexOfPipelines finds the start of the pipelines: entry
-func indexOfPipelines(lines []string) (int, error) {
-	return indexOfString(lines, "pipelines:")
+	err := util.WriteFileAtomic(pipelineConfigPath, content, func(path string) error {
+		_, err := LoadProjectConfig(path)
+		return err
+	})
+	if err != nil {
+		logger.Errorf("leaving '%s' unchanged: %s", pipelineConfigPath, err)
+		return err
+	}
+	return nil
 }
 
-// indexOfPipeline finds the start of the pipeline: entry
-func indexOfPipeline(lines []string) (int, error) {
-	return indexOfString(lines, "pipeline:")
+func (e *Patcher) createApplicationStep(name string, properties map[string]string, template string) *Step {
+	// build the set of arguments for the script
+	args := []string{}
+	if e.sqServer != "" {
+		args = append(args, "-s "+e.sqServer)
+	}
+	if e.apiKey != "" {
+		args = append(args, "-k "+e.apiKey)
+	}
+	args = append(args, "-r "+strconv.FormatBool(e.scanonrelease))
+	args = append(args, "-p "+strconv.FormatBool(e.scanonpreview))
+	if e.scanonfeature {
+		args = append(args, "-f "+strconv.FormatBool(e.scanonfeature))
+	}
+	if e.debug {
+		args = append(args, "-v "+strconv.FormatBool(e.debug))
+	}
+	if e.allContexts && e.context != "" {
+		// Keep the results of each context apart in SonarQube
+		args = append(args, "-x "+e.context)
+	}
+	if template != "" {
+		args = append(args, "-t "+template)
+	}
+	args = append(args, propertyArgs(properties)...)
+
+	// construct the pipeline syntax for the step
+	return NewStep(name, "/usr/local/bin/exec-sonar-scanner.sh", args, version.GetFQImage())
 }
 
-// indexOfPipeline finds the start of the pipeline: entry
-func indexOfStages(lines []string) (int, error) {
-	return indexOfString(lines, "stages:")
+func nspaces(n int) string {
+	s := make([]byte, n)
+	for i := 0; i < n; i++ {
+		s[i] = ' '
+	}
+	return string(s)
 }
 
-// envExists checks if the buildpack env variable is already set
-func envExists(lines []string, index int) bool {
-	return strings.Contains(lines[index], "name:") && strings.Contains(lines[index], "BUILDPACK_NAME")
+// getBuildPack returns the build pack of the effective pipeline: its buildPack wherever it is in the document,
+// or else the build pack whose pipeline it extends
+func getBuildPack(root *yaml.Node) string {
+	if buildPack := scalarValue(root, "buildPack"); buildPack != "" {
+		return buildPack
+	}
+	file := scalarValue(mappingValue(mappingValue(root, "pipelineConfig"), "extends"), "file")
+	buildPack := extendedBuildPack(file)
+	if buildPack != "" {
+		logger.Debugf("No buildPack given, using %s from pipelineConfig.extends.file '%s'", buildPack, file)
+	}
+	return buildPack
 }
 
-// isNamedStage checks if this line contains the name: declaration for stage 'name'
-func isNamedStage(line string, name string) bool {
-	return strings.Contains(line, "name:") && strings.Contains(line, name)
+// extendedBuildPack returns the build pack of the pipeline file a pipeline extends, which is the directory
+// holding it, such as go for go/pipeline.yaml or ../javascript/pipeline.yaml. Build packs kept in a
+// subdirectory of their repository keep the path, such as packs/go, and are matched by their last element.
+func extendedBuildPack(file string) string {
+	if file == "" {
+		return ""
+	}
+	dir := path.Dir(path.Clean(filepath.ToSlash(file)))
+	for strings.HasPrefix(dir, "../") {
+		dir = strings.TrimPrefix(dir, "../")
+	}
+	if dir == "." || dir == ".." || dir == "/" {
+		return ""
+	}
+	return strings.TrimPrefix(dir, "/")
 }
 
 // dumpInput writes pipeline to log to check input format
 func dumpInput(content []byte) {
-	// Dump pipeline to log to check input format
-	fmt.Println("---------------------------INPUT PIPELINE---------------------------")
-	fmt.Println(string(content))
-	fmt.Println("--------------------------------------------------------------------")
+	// Dump pipeline to log to check input format, never to stdout when it holds the diff or the decisions
+	out := logging.Output()
+	fmt.Fprintln(out, "---------------------------INPUT PIPELINE---------------------------")
+	fmt.Fprintln(out, string(content))
+	fmt.Fprintln(out, "--------------------------------------------------------------------")
 }
 
 // dumpOutput writes pipeline to log to check output format
 func dumpOutput(path string) {
-	fmt.Println("--------------------------OUTPUT PIPELINE---------------------------")
+	out := logging.Output()
+	fmt.Fprintln(out, "--------------------------OUTPUT PIPELINE---------------------------")
 	content, err := ioutil.ReadFile(path)
 	if err != nil {
 		logger.Fatalf("unable to display pipeline config '%s'", path)
 	}
-	fmt.Println(string(content))
-	fmt.Println("--------------------------------------------------------------------")
+	fmt.Fprintln(out, string(content))
+	fmt.Fprintln(out, "--------------------------------------------------------------------")
 }
@@ -1,6 +1,8 @@
 package pipeline
 
 import (
+	"bytes"
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -8,7 +10,10 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/jenkins-x-apps/jx-app-sonar-scanner/internal/util"
 	jxutil "github.com/jenkins-x/jx/v2/pkg/util"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/udhos/equalfile"
 )
@@ -22,6 +27,7 @@ func TestPatcher_ConfigurePipeline(t *testing.T) {
 		apiKey        string
 		scanonpreview bool
 		scanonrelease bool
+		scanonfeature bool
 	}
 
 	// Test data
@@ -41,28 +47,58 @@ func TestPatcher_ConfigurePipeline(t *testing.T) {
 		fields  fields
 		wantErr bool
 	}{
-		{"go", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true}, false},
-		{"go-preview", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, false}, false},
-		{"go-release", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", false, true}, false},
-		{"go-none", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", false, false}, false},
-		{"go-no-token", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "", true, true}, false},
-		{"go-no-server", fields{"", "", "12345", true, true}, false},
-		{"go-override", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true}, false},
-		{"go-override-quiet", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true}, false},
-		{"go-skip", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true}, false},
-		{"gradle", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true}, false},
-		{"javascript", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true}, false},
-		{"maven", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true}, false},
-		{"ml-python-gpu-service", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true}, false},
-		{"ml-python-gpu-training", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true}, false},
-		{"ml-python-gpu-training-with-env", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true}, false},
-		{"ml-python-service", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true}, false},
-		{"ml-python-training", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true}, false},
-		{"python", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true}, false},
-		{"scala", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true}, false},
-		{"typescript", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true}, false},
-		{"unknown-step-name", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true}, false},
-		{"unknown-builder", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true}, false},
+		{"go", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"go-preview", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, false, false}, false},
+		{"go-release", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", false, true, false}, false},
+		{"go-none", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", false, false, false}, false},
+		{"go-no-token", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "", true, true, false}, false},
+		{"go-no-server", fields{"", "", "12345", true, true, false}, false},
+		{"go-override", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"go-override-glob", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"go-override-regex", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"go-override-ambiguous", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, true},
+		{"go-override-feature", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, true}, false},
+		{"go-override-quiet", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"go-exact-match", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"go-existing-step", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"go-feature", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, true}, false},
+		{"go-flow-comments", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"go-position-before", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"go-position-first-in-stage", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"go-position-last-in-stage", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"go-position-new-stage", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"go-multiple-scans", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"go-multiple-scans-new-stage", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"go-multiple-scans-duplicate", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, true},
+		{"go-nested-stages", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"go-nested-stages-ambiguous", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, true},
+		{"go-properties", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"go-skip", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"go-skip-exemption", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"go-skip-expired", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"go-buildpack-reordered", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"go-extends", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"custom-discover-detected", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"custom-discover", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"go-invalid-overrides", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"go-override-exact-stage", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"go-override-legacy-stage", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"go-fallback", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"go-detected", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"go-rollout", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"gradle", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"javascript", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"maven", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"ml-python-gpu-service", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"ml-python-gpu-training", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"ml-python-gpu-training-with-env", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"ml-python-service", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"ml-python-training", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"python", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"scala", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"typescript", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"unknown-step-name", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
+		{"unknown-builder", fields{"", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false}, false},
 	}
 
 	cmp := equalfile.New(nil, equalfile.Options{})
@@ -83,6 +119,7 @@ func TestPatcher_ConfigurePipeline(t *testing.T) {
 				apiKey:        tt.fields.apiKey,
 				scanonpreview: tt.fields.scanonpreview,
 				scanonrelease: tt.fields.scanonrelease,
+				scanonfeature: tt.fields.scanonfeature,
 				debug:         false,
 			}
 			if err := e.ConfigurePipeline(); (err != nil) != tt.wantErr {
@@ -95,45 +132,358 @@ func TestPatcher_ConfigurePipeline(t *testing.T) {
 	}
 }
 
-func Test_indexOfEndOfPipeline(t *testing.T) {
+func TestPatcher_ConfigurePipeline_rerun(t *testing.T) {
+	t.Parallel()
 
 	// Test data
 	testDataLocation := "../../test/"
 
-	type args struct {
-		start  int
-		indent int
+	tests := []string{
+		"go",
+		"go-existing-step",
+		"go-multiple-scans",
+		"go-multiple-scans-new-stage",
+		"go-nested-stages",
+		"go-position-new-stage",
+		"ml-python-gpu-training-with-env",
+	}
+
+	cmp := equalfile.New(nil, equalfile.Options{})
+
+	for _, name := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir(testDataLocation, "rerun-"+name)
+			assert.NoError(t, err)
+			defer func() {
+				err := os.RemoveAll(dir)
+				assert.NoError(t, err)
+			}()
+			err = jxutil.CopyDir(filepath.Join(testDataLocation, name), dir, true)
+			assert.NoError(t, err)
+
+			e := NewPatcher(dir, "", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false)
+			for run := 1; run <= 2; run++ {
+				err = e.ConfigurePipeline()
+				assert.NoError(t, err)
+
+				equal, err := cmp.CompareFile(filepath.Join(dir, "jenkins-x-effective.yml"), filepath.Join(dir, "jenkins-x-effective.gold.yml"))
+				assert.NoError(t, err)
+				assert.True(t, equal, "pipeline files don't match after run %d", run)
+
+				equal, err = cmp.CompareFile(filepath.Join(dir, "jenkins-x-effective.yml.sonar-scanner.orig"), filepath.Join(testDataLocation, name, "jenkins-x-effective.yml"))
+				assert.NoError(t, err)
+				assert.True(t, equal, "backup is not the original pipeline after run %d", run)
+			}
+		})
 	}
+}
+
+func TestPatcher_ConfigurePipeline_dryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("../../test/", "dryrun-go")
+	assert.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	}()
+	err = jxutil.CopyDir("../../test/go", dir, true)
+	assert.NoError(t, err)
+
+	out := &bytes.Buffer{}
+	e := NewPatcher(dir, "", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false)
+	e.out = out
+	e.SetDryRun(true)
+	err = e.ConfigurePipeline()
+	assert.NoError(t, err)
+
+	equal, err := equalfile.New(nil, equalfile.Options{}).CompareFile(filepath.Join(dir, "jenkins-x-effective.yml"), "../../test/go/jenkins-x-effective.yml")
+	assert.NoError(t, err)
+	assert.True(t, equal, "dry run changed the pipeline")
+	assert.False(t, util.Exists(filepath.Join(dir, "jenkins-x-effective.yml.sonar-scanner.orig")), "dry run created a backup")
+
+	diff := out.String()
+	assert.True(t, strings.HasPrefix(diff, "--- a/jenkins-x-effective.yml\n+++ b/jenkins-x-effective.yml\n"), diff)
+	assert.Contains(t, diff, "+            - name: BUILDPACK_NAME\n")
+	assert.Contains(t, diff, "+            name: sonar-scanner\n")
+}
+
+func TestPatcher_ConfigurePipeline_outputJSON(t *testing.T) {
 	tests := []struct {
-		name    string
-		file    string
-		args    args
-		want    int
-		wantErr bool
+		name string
+		want []Decision
 	}{
-		{"indexEndOfPipeline1", "indexEndOfPipeline1.yml", args{11, 4}, 86, false}, // Zero-referenced, start AFTER beginnning of this pipeline
-		{"indexEndOfPipeline2", "indexEndOfPipeline1.yml", args{88, 4}, 182, false},
-		{"indexEndOfPipeline3", "indexEndOfPipeline2.yml", args{8, 4}, 71, false},
-		{"indexEndOfPipeline4", "indexEndOfPipeline3.yml", args{8, 4}, 75, false},
+		{"go-position-before", []Decision{
+			{Pipeline: "pullRequest", Action: ActionInsert, Position: PositionBefore, Stage: "build", StageLine: 62, Step: "build-container-build", StepLine: 70, ScanLine: 72, EnvLine: 16},
+			{Pipeline: "release", Action: ActionInsert, Position: PositionBefore, Stage: "build", StageLine: 139, Step: "build-make-build", StepLine: 147, ScanLine: 159, EnvLine: 103},
+		}},
+		{"go-existing-step", []Decision{
+			{Pipeline: "pullRequest", Action: ActionUpdate, Step: "sonar-scanner", StepLine: 70, ScanLine: 72, EnvLine: 16},
+			{Pipeline: "release", Action: ActionUpdate, Step: "quality-gate", StepLine: 157, ScanLine: 163, EnvLine: 103},
+		}},
+		{"go-multiple-scans", []Decision{
+			{Pipeline: "pullRequest", Scan: "sonar-unit", Action: ActionInsert, Position: PositionAfter, Stage: "from-build-pack", StageLine: 62, Step: "build-make-linux", StepLine: 66, ScanLine: 72, EnvLine: 16},
+			{Pipeline: "pullRequest", Scan: "sonar-integration", Action: ActionInsert, Position: PositionAfter, Stage: "from-build-pack", StageLine: 62, Step: "postbuild-post-build", StepLine: 76, ScanLine: 91, EnvLine: 16},
+			{Pipeline: "release", Action: ActionInsert, Position: PositionAfter, Stage: "from-build-pack", StageLine: 139, Step: "build-make-build", StepLine: 147, ScanLine: 173, EnvLine: 113},
+		}},
+		{"go-detected", []Decision{
+			{Pipeline: "pullRequest", Action: ActionInsert, Position: PositionAfter, Stage: "from-build-pack", StageLine: 62, Step: "build-make-linux", StepLine: 66, ScanLine: 72, EnvLine: 16, Detection: &Detection{BuildPack: "go", Confidence: ConfidenceHigh, Evidence: []string{"go.mod"}}},
+			{Pipeline: "release", Action: ActionInsert, Position: PositionAfter, Stage: "from-build-pack", StageLine: 139, Step: "build-make-build", StepLine: 147, ScanLine: 163, EnvLine: 103, Detection: &Detection{BuildPack: "go", Confidence: ConfidenceHigh, Evidence: []string{"go.mod"}}},
+		}},
+		{"go-fallback", []Decision{
+			{Pipeline: "pullRequest", Action: ActionInsert, Position: PositionAfter, Stage: "from-build-pack", StageLine: 62, Step: "build-make-build", StepLine: 66, ScanLine: 72, EnvLine: 16},
+			{Pipeline: "release", Action: ActionInsert, Position: PositionAfter, Stage: "from-build-pack", StageLine: 139, Step: "build-make-build", StepLine: 147, ScanLine: 163, EnvLine: 103},
+		}},
+		{"custom-discover", []Decision{
+			{Pipeline: "pullRequest", Action: ActionInsert, Position: PositionAfter, Stage: "ci", StageLine: 9, Step: "unit-tests", StepLine: 17, ScanLine: 22, EnvLine: 4, Discovered: "mvn install"},
+			{Pipeline: "release", Action: ActionSkip, Reason: "no anchor for buildPack 'none' and none discovered"},
+		}},
+		{"custom-discover-detected", []Decision{
+			{Pipeline: "pullRequest", Action: ActionInsert, Position: PositionAfter, Stage: "ci", StageLine: 9, Step: "tests", StepLine: 13, ScanLine: 18, EnvLine: 4, Discovered: "make test", Detection: &Detection{BuildPack: "go", Confidence: ConfidenceHigh, Evidence: []string{"go.mod"}}},
+			{Pipeline: "release", Action: ActionSkip, Reason: "no anchor for buildPack 'go' and none discovered", Position: PositionAfter, Stage: "from-build-pack", Step: "build-make-build", Detection: &Detection{BuildPack: "go", Confidence: ConfidenceHigh, Evidence: []string{"go.mod"}}},
+		}},
+		{"go-override-legacy-stage", []Decision{
+			{Pipeline: "pullRequest", Action: ActionInsert, Position: PositionAfter, Stage: "build", StageLine: 62, Step: "container-build", StepLine: 70, ScanLine: 78, EnvLine: 16},
+			{Pipeline: "release", Action: ActionInsert, Position: PositionAfter, Stage: "build", StageLine: 139, Step: "build-post", StepLine: 157, ScanLine: 174, EnvLine: 104},
+		}},
+		{"go-override-exact-stage", []Decision{
+			{Pipeline: "pullRequest", Action: ActionSkip, Reason: "unable to find stage 'build' (names are matched exactly, did you mean 'from-build-pack'?)", Position: PositionAfter, Stage: "build", Step: "build-container-build"},
+			{Pipeline: "release", Action: ActionSkip, Reason: "unable to find stage 'build' (names are matched exactly, did you mean 'from-build-pack'?)", Position: PositionAfter, Stage: "build", Step: "build-container-build"},
+		}},
+		{"unknown-step-name", []Decision{
+			{Pipeline: "pullRequest", Action: ActionSkip, Reason: "unable to find any of step 'build-make-linux', step 'build-make-build'", Position: PositionAfter, Stage: "from-build-pack", StageLine: 62, Step: "build-make-linux"},
+			{Pipeline: "release", Action: ActionSkip, Reason: "unable to find any of step 'build-make-build', step 'build-make-linux'", Position: PositionAfter, Stage: "from-build-pack", StageLine: 139, Step: "build-make-build"},
+		}},
+		{"go-invalid-overrides", []Decision{
+			{Pipeline: "pullRequest", Action: ActionSkip, Reason: "invalid .jx-app-sonar-scanner.yaml"},
+			{Pipeline: "release", Action: ActionSkip, Reason: "invalid .jx-app-sonar-scanner.yaml"},
+		}},
+		{"go-skip", []Decision{
+			{Pipeline: "pullRequest", Action: ActionSkip, Reason: "skipped by user overrides"},
+			{Pipeline: "release", Action: ActionSkip, Reason: "skipped by user overrides"},
+		}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			dataTemplateLocation := filepath.Join(testDataLocation, tt.file)
-			content, err := ioutil.ReadFile(dataTemplateLocation)
+			out := &bytes.Buffer{}
+			e := NewPatcher("../../test/"+tt.name, "", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false)
+			e.out = out
+			e.SetDryRun(true)
+			err := e.SetOutput(OutputJSON)
 			assert.NoError(t, err)
-			lines := strings.Split(string(content), "\n")
-			got, err := indexOfEndOfPipeline(lines, tt.args.start, tt.args.indent)
-			if (err != nil) != tt.wantErr {
-				t.Errorf("indexOfEndOfPipeline() error = %v, wantErr %v", err, tt.wantErr)
-				return
-			}
-			if got != tt.want {
-				t.Errorf("indexOfEndOfPipeline() = %v, want %v", got, tt.want)
+			err = e.ConfigurePipeline()
+			assert.NoError(t, err)
+
+			got := []Decision{}
+			err = json.Unmarshal(out.Bytes(), &got)
+			assert.NoError(t, err, out.String())
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPatcher_ConfigurePipeline_outputJSON_verbose(t *testing.T) {
+	stderr := &bytes.Buffer{}
+	log.SetOutput(stderr)
+	defer log.SetOutput(os.Stdout)
+
+	// The fixture turns on verbose, which dumps the pipeline
+	out := &bytes.Buffer{}
+	e := NewPatcher("../../test/go-override", "", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false)
+	e.out = out
+	e.SetDryRun(true)
+	err := e.SetOutput(OutputJSON)
+	assert.NoError(t, err)
+	err = e.ConfigurePipeline()
+	assert.NoError(t, err)
+
+	got := []Decision{}
+	err = json.Unmarshal(out.Bytes(), &got)
+	assert.NoError(t, err, out.String())
+	assert.Len(t, got, 2)
+	assert.Contains(t, stderr.String(), "INPUT PIPELINE")
+}
+
+func TestPatcher_ConfigurePipeline_skipRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		want   string
+		reason string
+	}{
+		{"renovate", map[string]string{"PIPELINE_KIND": "pullrequest", "BRANCH_NAME": "renovate/golang-1.x", "PULL_BASE_REF": "main"}, "jenkins-x-effective.yml", "skip rule {branch=renovate/*} matched"},
+		{"other base", map[string]string{"PIPELINE_KIND": "pullrequest", "BRANCH_NAME": "PR-12", "PULL_BASE_REF": "develop"}, "jenkins-x-effective.yml", "no only rule matched"},
+		{"main", map[string]string{"PIPELINE_KIND": "pullrequest", "BRANCH_NAME": "PR-12", "PULL_BASE_REF": "main"}, "../go/jenkins-x-effective.gold.yml", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("../../test/", "rules-go")
+			assert.NoError(t, err)
+			defer func() {
+				err := os.RemoveAll(dir)
+				assert.NoError(t, err)
+			}()
+			err = jxutil.CopyDir("../../test/go-skip-rules", dir, true)
+			assert.NoError(t, err)
+
+			e := NewPatcher(dir, "", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false)
+			e.env = func(key string) string { return tt.env[key] }
+			err = e.ConfigurePipeline()
+			assert.NoError(t, err)
+
+			equal, err := equalfile.New(nil, equalfile.Options{}).CompareFile(filepath.Join(dir, "jenkins-x-effective.yml"), filepath.Join("../../test/go-skip-rules", tt.want))
+			assert.NoError(t, err)
+			assert.True(t, equal, "pipeline files don't match")
+			for _, decision := range e.decisions {
+				assert.Equal(t, tt.reason, decision.Reason)
 			}
 		})
 	}
 }
 
+func TestPatcher_ConfigurePipeline_invalidOverrides(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+
+	e := NewPatcher("../../test/go-invalid-overrides", "", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false)
+	e.SetDryRun(true)
+	err := e.ConfigurePipeline()
+	assert.NoError(t, err, "an invalid override file must not break the build")
+
+	problems := []string{}
+	skipped := false
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.ErrorLevel {
+			problems = append(problems, entry.Message)
+		}
+		if entry.Data["sonarscanskip"] == true {
+			assert.Equal(t, log.WarnLevel, entry.Level)
+			skipped = true
+		}
+	}
+	assert.Equal(t, []string{"../../test/go-invalid-overrides/.jx-app-sonar-scanner.yaml:5:5: unknown field 'pullRequest.stpe', expected one of: name, position, properties, stage, step"}, problems)
+	assert.True(t, skipped)
+}
+
+func TestPatcher_ConfigurePipeline_missingAnchor(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+
+	e := NewPatcher("../../test/unknown-step-name", "", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false)
+	e.SetDryRun(true)
+	err := e.ConfigurePipeline()
+	assert.NoError(t, err)
+
+	warnings := []string{}
+	for _, entry := range hook.AllEntries() {
+		if entry.Data["sonarscananchor"] == "missing" {
+			assert.Equal(t, log.WarnLevel, entry.Level)
+			assert.Equal(t, "go", entry.Data["buildPack"])
+			warnings = append(warnings, entry.Message)
+		}
+	}
+	assert.Equal(t, []string{
+		"Skipping scan on pullRequest pipeline: unable to find any of step 'build-make-linux', step 'build-make-build'. Tried after step 'build-make-linux' of stage 'from-build-pack', after step 'build-make-build' of stage 'from-build-pack'. Set the anchor in .jx-app-sonar-scanner.yaml or in the build pack registry.",
+		"Skipping scan on release pipeline: unable to find any of step 'build-make-build', step 'build-make-linux'. Tried after step 'build-make-build' of stage 'from-build-pack', after step 'build-make-linux' of stage 'from-build-pack'. Set the anchor in .jx-app-sonar-scanner.yaml or in the build pack registry.",
+	}, warnings)
+}
+
+func TestPatcher_ConfigurePipeline_buildPacks(t *testing.T) {
+	dir, err := ioutil.TempDir("../../test/", "buildpacks-go")
+	assert.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	}()
+	err = jxutil.CopyDir("../../test/custom-buildpack", dir, true)
+	assert.NoError(t, err)
+
+	e := NewPatcher(dir, "", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false)
+	e.SetBuildPacks(filepath.Join(dir, "buildpacks.yaml"))
+	err = e.ConfigurePipeline()
+	assert.NoError(t, err)
+
+	equal, err := equalfile.New(nil, equalfile.Options{}).CompareFile(filepath.Join(dir, "jenkins-x-effective.yml"), "../../test/custom-buildpack/jenkins-x-effective.gold.yml")
+	assert.NoError(t, err)
+	assert.True(t, equal, "pipeline files don't match")
+
+	e = NewPatcher(dir, "", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false)
+	e.SetBuildPacks("../../test/buildpacks/incomplete.yaml")
+	err = e.ConfigurePipeline()
+	assert.EqualError(t, err, "invalid build packs in '../../test/buildpacks/incomplete.yaml': build pack 'rust' has no anchor for release pipelines")
+}
+
+func TestPatcher_SetOutput(t *testing.T) {
+	e := NewPatcher(".", "", "", "", true, true, false)
+	assert.NoError(t, e.SetOutput(OutputText))
+	assert.NoError(t, e.SetOutput(OutputJSON))
+	assert.Error(t, e.SetOutput("yaml"))
+}
+
+func TestPatcher_ConfigurePipeline_allContexts(t *testing.T) {
+	dir, err := ioutil.TempDir("../../test/", "contexts-go")
+	assert.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	}()
+	err = jxutil.CopyDir("../../test/go-all-contexts", dir, true)
+	assert.NoError(t, err)
+
+	out := &bytes.Buffer{}
+	e := NewPatcher(dir, "", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false)
+	e.out = out
+	e.SetAllContexts(true)
+	err = e.ConfigurePipeline()
+	assert.NoError(t, err)
+
+	cmp := equalfile.New(nil, equalfile.Options{})
+	for _, context := range []string{"", "arm", "docs"} {
+		file := effectiveConfigFile(context)
+		equal, err := cmp.CompareFile(filepath.Join(dir, file), filepath.Join(dir, strings.TrimSuffix(file, ".yml")+".gold.yml"))
+		assert.NoError(t, err)
+		assert.True(t, equal, "pipeline files don't match for %s", file)
+	}
+
+	summary := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, summary, 4)
+	assert.Regexp(t, `^arm\s+jenkins-x-arm-effective.yml\s+patched\s+pullRequest: insert, release: insert$`, summary[1])
+	assert.Regexp(t, `^docs\s+jenkins-x-docs-effective.yml\s+skipped\s+pullRequest: no anchor for buildPack 'darkmagic'`, summary[2])
+	assert.Regexp(t, `^default\s+jenkins-x-effective.yml\s+patched\s+`, summary[3])
+}
+
+func TestPatcher_findContexts(t *testing.T) {
+	e := NewPatcher("../../test/go-all-contexts", "", "", "", true, true, false)
+	contexts, err := e.findContexts()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"arm", "docs", ""}, contexts)
+
+	e = NewPatcher("../../test/files", "", "", "", true, true, false)
+	_, err = e.findContexts()
+	assert.Error(t, err)
+}
+
+func TestPatcher_writeProjectConfig_invalid(t *testing.T) {
+	dir, err := ioutil.TempDir("../../test/", "write-go")
+	assert.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	}()
+	err = jxutil.CopyDir("../../test/go", dir, true)
+	assert.NoError(t, err)
+	path := filepath.Join(dir, "jenkins-x-effective.yml")
+
+	e := NewPatcher(dir, "", "", "", true, true, false)
+	err = e.writeProjectConfig([]byte("buildPack: go\npipelineConfig: [\n"), path)
+	assert.Error(t, err)
+
+	equal, err := equalfile.New(nil, equalfile.Options{}).CompareFile(path, "../../test/go/jenkins-x-effective.yml")
+	assert.NoError(t, err)
+	assert.True(t, equal, "original pipeline was modified")
+	files, err := filepath.Glob(filepath.Join(dir, ".jenkins-x-effective.yml.tmp-*"))
+	assert.NoError(t, err)
+	assert.Empty(t, files, "temporary file left behind")
+}
+
 func TestPatcher_getUserOverrides(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -143,10 +493,16 @@ func TestPatcher_getUserOverrides(t *testing.T) {
 	}{
 		{"good", UserOverrides{
 			Verbose:     true,
-			Skip:        false,
-			PullRequest: BuildStep{Stage: "ci", Step: "make-build"},
-			Release:     BuildStep{Stage: "release", Step: "make-release"},
+			Skip:        Skip{},
+			PullRequest: BuildSteps{{Stage: "ci", Step: "make-build"}},
+			Release:     BuildSteps{{Stage: "release", Step: "make-release"}},
 		}, "good.yaml", false},
+		{"versioned", UserOverrides{
+			Verbose:     true,
+			Skip:        Skip{},
+			PullRequest: BuildSteps{{Stage: "ci", Step: "make-build"}},
+			Release:     BuildSteps{{Stage: "release", Step: "make-release"}},
+		}, "versioned.yaml", false},
 		{"broken", UserOverrides{}, "broken.yaml", true},
 		{"absent", UserOverrides{}, "absent.yaml", false},
 	}
@@ -155,7 +511,7 @@ func TestPatcher_getUserOverrides(t *testing.T) {
 			e := &Patcher{
 				sourceDir: "../../test/user-properties/",
 			}
-			got, err := e.getUserOverrides(tt.file)
+			got, _, err := e.getUserOverrides(tt.file)
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("Patcher.getUserOverrides() got = %v, want %v", got, tt.want)
 			}
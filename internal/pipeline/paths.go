@@ -0,0 +1,135 @@
+package pipeline
+
+import (
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	pullBaseShaEnv = "PULL_BASE_SHA"
+	// pullRequestKind is the PIPELINE_KIND of pull request builds
+	pullRequestKind = "pullrequest"
+)
+
+// PathFilter selects the files whose changes make a pull request worth scanning. Patterns are
+// shell globs over slash separated paths relative to the repository root, where ** matches any
+// number of directories.
+type PathFilter struct {
+	Include []string `yaml:"include,omitempty"`
+	Exclude []string `yaml:"exclude,omitempty"`
+}
+
+// empty reports whether the filter lets every change through
+func (f PathFilter) empty() bool {
+	return len(f.Include) == 0 && len(f.Exclude) == 0
+}
+
+// relevant returns the files that are included and not excluded by the filter
+func (f PathFilter) relevant(files []string) []string {
+	relevant := []string{}
+	for _, file := range files {
+		if len(f.Include) > 0 && !matchAnyGlob(f.Include, file) {
+			continue
+		}
+		if matchAnyGlob(f.Exclude, file) {
+			continue
+		}
+		relevant = append(relevant, file)
+	}
+	return relevant
+}
+
+func matchAnyGlob(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchGlob(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob matches a slash separated path against a pattern in which ** matches any number of path segments
+func matchGlob(pattern string, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern []string, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	matched, err := path.Match(pattern[0], name[0])
+	if err != nil || !matched {
+		return false
+	}
+	return matchSegments(pattern[1:], name[1:])
+}
+
+// gitChangedFiles lists the files changed between base and HEAD in the git checkout at dir
+func gitChangedFiles(dir string, base string) ([]string, error) {
+	cmd := exec.Command("git", "diff", "--name-only", base, "HEAD")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, errors.Wrapf(err, "git diff against %s failed: %s", base, strings.TrimSpace(string(out)))
+	}
+	files := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line != "" {
+			files = append(files, line)
+		}
+	}
+	return files, nil
+}
+
+// applyPathFilter decides whether the pull request has changed any file worth scanning, and logs the
+// decision together with the files behind it. Only pull request builds are filtered. Without a base commit,
+// or if git fails, the scan goes ahead.
+func (e *Patcher) applyPathFilter(filter PathFilter) (bool, string) {
+	if filter.empty() {
+		return false, ""
+	}
+	if kind := e.getenv(pipelineKindEnv); kind != pullRequestKind {
+		logger.Debugf("%s is '%s' and not %s, ignoring paths", pipelineKindEnv, kind, pullRequestKind)
+		return false, ""
+	}
+	base := e.getenv(pullBaseShaEnv)
+	if base == "" {
+		logger.Debugf("%s is not set, ignoring paths", pullBaseShaEnv)
+		return false, ""
+	}
+	files, err := gitChangedFiles(e.sourceDir, base)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"sonarscanskip": false,
+		}).Warnf("Unable to find changed files, scanning anyway: %s", err)
+		return false, ""
+	}
+	relevant := filter.relevant(files)
+	entry := log.WithFields(log.Fields{
+		"sonarscanskip": len(relevant) == 0,
+		"basesha":       base,
+		"changedfiles":  strings.Join(files, ","),
+		"relevantfiles": strings.Join(relevant, ","),
+	})
+	if len(relevant) == 0 {
+		entry.Warn("Skipping sonar scan of pull request as no relevant file changed")
+		return true, "no relevant file changed"
+	}
+	entry.Info("Sonar scan of pull request required by changed files")
+	return false, ""
+}
@@ -0,0 +1,113 @@
+package pipeline
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	jxutil "github.com/jenkins-x/jx/v2/pkg/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/udhos/equalfile"
+)
+
+func Test_matchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"go.mod", "go.mod", true},
+		{"*.md", "README.md", true},
+		{"*.md", "docs/README.md", false},
+		{"**/*.md", "README.md", true},
+		{"**/*.md", "docs/guide/README.md", true},
+		{"docs/**", "docs/guide/README.md", true},
+		{"docs/**", "src/docs/README.md", false},
+		{"src/**/*.go", "src/main.go", true},
+		{"src/**/*.go", "src/pkg/util/util.go", true},
+		{"src/**/*.go", "src/pkg/util/util.md", false},
+		{"[", "[", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+"/"+tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, matchGlob(tt.pattern, tt.name))
+		})
+	}
+}
+
+func TestPathFilter_relevant(t *testing.T) {
+	files := []string{"README.md", "docs/guide.md", "cmd/main.go", "internal/util/util.go", "go.mod"}
+
+	assert.Equal(t, files, PathFilter{}.relevant(files))
+	assert.Equal(t, []string{"cmd/main.go", "internal/util/util.go", "go.mod"}, PathFilter{Exclude: []string{"**/*.md"}}.relevant(files))
+	assert.Equal(t, []string{"internal/util/util.go"}, PathFilter{Include: []string{"internal/**"}}.relevant(files))
+	assert.Equal(t, []string{"cmd/main.go"}, PathFilter{Include: []string{"**/*.go"}, Exclude: []string{"internal/**"}}.relevant(files))
+	assert.Empty(t, PathFilter{Exclude: []string{"**"}}.relevant(files))
+}
+
+func TestPatcher_ConfigurePipeline_paths(t *testing.T) {
+	tests := []struct {
+		name    string
+		kind    string
+		changed string
+		want    string
+	}{
+		{"docs only", "pullrequest", "docs/guide.md", "../go-paths/jenkins-x-effective.gold.yml"},
+		{"code", "pullrequest", "main.go", "../go/jenkins-x-effective.gold.yml"},
+		{"release", "release", "docs/guide.md", "../go/jenkins-x-effective.gold.yml"},
+		{"no kind", "", "docs/guide.md", "../go/jenkins-x-effective.gold.yml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("../../test/", "paths-go")
+			assert.NoError(t, err)
+			defer func() {
+				err := os.RemoveAll(dir)
+				assert.NoError(t, err)
+			}()
+			err = jxutil.CopyDir("../../test/go-paths", dir, true)
+			assert.NoError(t, err)
+			err = os.Remove(filepath.Join(dir, "jenkins-x-effective.gold.yml"))
+			assert.NoError(t, err)
+
+			git := func(args ...string) string {
+				cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+				cmd.Dir = dir
+				out, err := cmd.CombinedOutput()
+				assert.NoError(t, err, string(out))
+				return string(out)
+			}
+			git("init", "-q")
+			git("add", "-A")
+			git("commit", "-q", "-m", "base")
+			base := git("rev-parse", "HEAD")
+			err = os.MkdirAll(filepath.Dir(filepath.Join(dir, tt.changed)), 0755)
+			assert.NoError(t, err)
+			err = ioutil.WriteFile(filepath.Join(dir, tt.changed), []byte("changed\n"), 0644)
+			assert.NoError(t, err)
+			git("add", "-A")
+			git("commit", "-q", "-m", "change")
+
+			env := map[string]string{"PIPELINE_KIND": tt.kind, "PULL_BASE_SHA": base[:len(base)-1]}
+			e := NewPatcher(dir, "", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false)
+			e.env = func(key string) string { return env[key] }
+			err = e.ConfigurePipeline()
+			assert.NoError(t, err)
+
+			equal, err := equalfile.New(nil, equalfile.Options{}).CompareFile(filepath.Join(dir, "jenkins-x-effective.yml"), filepath.Join("../../test/go-paths", tt.want))
+			assert.NoError(t, err)
+			assert.True(t, equal, "pipeline files don't match")
+		})
+	}
+}
+
+func Test_gitChangedFiles_noRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "paths-norepo")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = gitChangedFiles(dir, "0000000")
+	assert.Error(t, err)
+}
@@ -0,0 +1,314 @@
+package pipeline
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/jenkins-x-apps/jx-app-sonar-scanner/internal/util"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v3"
+)
+
+const (
+	// DefaultPolicyFile is where the org policy is read from unless another file is given, typically a
+	// mounted ConfigMap
+	DefaultPolicyFile = "/etc/jx-app-sonar-scanner/policy.yaml"
+
+	// PolicyKind is the kind of document held by a policy file
+	PolicyKind = "SonarScannerPolicy"
+)
+
+// skipSettings are the settings besides skip that leave builds unscanned. Locking skip locks them as well, or a
+// repository could get around it.
+var skipSettings = []string{"rules", "paths", "rollout"}
+
+// Policy restricts which settings a repository may override, through its own override file or the
+// environment of its pipeline. The org defaults are not restricted.
+type Policy struct {
+	// Locked settings keep the value of the org defaults, or the built-in default
+	Locked []string `yaml:"locked,omitempty"`
+	// Allowed lists the settings repositories may override. Every setting is allowed when it is not given.
+	Allowed []string `yaml:"allowed,omitempty"`
+	// Exempt lists the repositories the policy does not apply to, as owner/name shell patterns
+	Exempt []string `yaml:"exempt,omitempty"`
+
+	file string
+}
+
+// policySchema describes the org policy file
+func policySchema() *schema {
+	settings := func(description string) *schema {
+		return &schema{
+			Type:        schemaTypeArray,
+			Description: description,
+			Items:       &schema{Type: schemaTypeString},
+		}
+	}
+	return &schema{
+		Type:        schemaTypeObject,
+		Description: "Restricts which settings of .jx-app-sonar-scanner.yaml repositories may override.",
+		Required:    []string{"apiVersion", "kind"},
+		Properties: map[string]*schema{
+			"apiVersion": {
+				Type:        schemaTypeString,
+				Description: "The version of the file format.",
+				Enum:        []string{UserOverridesAPIVersion},
+			},
+			"kind": {
+				Type:        schemaTypeString,
+				Description: "The kind of document.",
+				Enum:        []string{PolicyKind},
+			},
+			"spec": {
+				Type:        schemaTypeObject,
+				Description: "The policy.",
+				Properties: map[string]*schema{
+					"locked":  settings("Settings, such as skip or release.stage, that repositories cannot override."),
+					"allowed": settings("The only settings repositories may override. Every setting is allowed when not given."),
+					"exempt":  settings("Repositories the policy does not apply to, as owner/name shell patterns."),
+				},
+			},
+		},
+	}
+}
+
+// loadPolicy reads the org policy, or returns nil if there is no such file
+func loadPolicy(file string) (*Policy, error) {
+	if file == "" || !util.Exists(file) {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Errorf("failed to open '%s'", file)
+	}
+	problems := validatePolicy(content)
+	if len(problems) > 0 {
+		return nil, errors.Wrapf(problemsError(problems), "unable to parse '%s'", file)
+	}
+	doc := &yaml.Node{}
+	err = yaml.Unmarshal(content, doc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse '%s'", file)
+	}
+	policy := &Policy{file: file}
+	if spec := mappingValue(rootNode(doc), "spec"); spec != nil {
+		err = spec.Decode(policy)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to parse '%s'", file)
+		}
+	}
+	return policy, nil
+}
+
+// validatePolicy checks the content of a policy file against its schema, and that the settings it names exist
+func validatePolicy(content []byte) []Problem {
+	doc := &yaml.Node{}
+	err := yaml.Unmarshal(content, doc)
+	if err != nil {
+		return []Problem{yamlProblem(err)}
+	}
+	root := rootNode(doc)
+	if root == nil || root.Kind == 0 {
+		return []Problem{{Line: 1, Column: 1, Message: "expected the file to set 'apiVersion' and 'kind'"}}
+	}
+	problems := []Problem{}
+	policySchema().validate(root, "", &problems)
+	if len(problems) > 0 {
+		return problems
+	}
+	spec := mappingValue(root, "spec")
+	for _, field := range []string{"locked", "allowed"} {
+		list := mappingValue(spec, field)
+		if list == nil {
+			continue
+		}
+		for i, item := range list.Content {
+			if settingsSchema().lookup(strings.Split(item.Value, ".")) == nil {
+				problems = append(problems, Problem{
+					Line:    item.Line,
+					Column:  item.Column,
+					Message: fmt.Sprintf("unknown setting '%s' in 'spec.%s[%d]'", item.Value, field, i),
+				})
+			}
+		}
+	}
+	return problems
+}
+
+// lookup returns the schema of the setting at path below an object, or nil if there is no such setting
+func (s *schema) lookup(path []string) *schema {
+	if len(path) == 0 {
+		return s
+	}
+	if len(s.OneOf) > 0 {
+		s = s.alternative(&yaml.Node{Kind: yaml.MappingNode})
+		if s == nil {
+			return nil
+		}
+	}
+	if s.AdditionalProperties != nil {
+		// Any key of a map can be named, including keys containing dots
+		return s.AdditionalProperties
+	}
+	property, ok := s.Properties[path[0]]
+	if !ok {
+		return nil
+	}
+	return property.lookup(path[1:])
+}
+
+// denies returns why the policy does not let repositories override the setting at path, or an empty string
+// if it does. A setting is locked when it, a setting it belongs to or a setting it holds is locked.
+func (p *Policy) denies(setting string) string {
+	for _, locked := range p.Locked {
+		if within(setting, locked) || within(locked, setting) {
+			return fmt.Sprintf("%s is locked", locked)
+		}
+	}
+	for _, locked := range p.impliedLocks() {
+		if within(setting, locked) || within(locked, setting) {
+			return fmt.Sprintf("skip is locked, which locks %s as well", locked)
+		}
+	}
+	if p.Allowed == nil {
+		return ""
+	}
+	for _, allowed := range p.Allowed {
+		if within(setting, allowed) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("%s is not in the allowed settings", setting)
+}
+
+// locks reports whether the setting at path is locked by the policy
+func (p *Policy) locks(setting string) bool {
+	for _, locked := range append(p.impliedLocks(), p.Locked...) {
+		if within(setting, locked) {
+			return true
+		}
+	}
+	return false
+}
+
+// impliedLocks returns the settings locked along with skip, or nothing when skip is not locked
+func (p *Policy) impliedLocks() []string {
+	if !util.Contains(p.Locked, "skip") {
+		return nil
+	}
+	return skipSettings
+}
+
+// within reports whether the setting at path is the setting at parent or one of its fields
+func within(setting string, parent string) bool {
+	return setting == parent || strings.HasPrefix(setting, parent+".")
+}
+
+// exemption returns the pattern exempting the repository from the policy, if there is one
+func (p *Policy) exemption(repo string) (string, error) {
+	for _, pattern := range p.Exempt {
+		matched, err := path.Match(pattern, repo)
+		if err != nil {
+			return "", errors.Wrapf(err, "invalid exempt pattern '%s' in '%s'", pattern, p.file)
+		}
+		if matched {
+			return pattern, nil
+		}
+	}
+	return "", nil
+}
+
+// enforce removes from a layer the settings the policy does not let repositories override. Every denied
+// setting is logged as a warning and as an audit entry.
+func (p *Policy) enforce(layer configLayer, repo string) configLayer {
+	var filter func(node *yaml.Node, s *schema, prefix string) *yaml.Node
+	filter = func(node *yaml.Node, s *schema, prefix string) *yaml.Node {
+		kept := newMappingNode()
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i].Value, node.Content[i+1]
+			if value.Kind == yaml.AliasNode {
+				value = value.Alias
+			}
+			if value.Kind == yaml.ScalarNode && value.Tag == "!!null" {
+				continue
+			}
+			child := key
+			if prefix != "" {
+				child = prefix + "." + key
+			}
+			property := s.property(key)
+			if property != nil && len(property.OneOf) > 0 {
+				property = property.alternative(value)
+			}
+			if property != nil && property.Type == schemaTypeObject && value.Kind == yaml.MappingNode {
+				if filtered := filter(value, property, child); len(filtered.Content) > 0 {
+					setMappingValue(kept, key, filtered)
+				}
+				continue
+			}
+			if reason := p.denies(child); reason != "" {
+				p.deny(child, value, layer.source(child), reason, repo)
+				continue
+			}
+			setMappingValue(kept, key, value)
+		}
+		return kept
+	}
+	return configLayer{node: filter(layer.node, settingsSchema(), ""), source: layer.source}
+}
+
+// deny logs an override the policy does not allow
+func (p *Policy) deny(setting string, value *yaml.Node, source string, reason string, repo string) {
+	logger.Warnf("Ignoring %s=%s from %s as the org policy does not allow it: %s", setting, describeValue(value), source, reason)
+	log.WithFields(log.Fields{
+		"sonarscanpolicy": "denied",
+		"policy":          p.file,
+		"repo":            repo,
+		"setting":         setting,
+		"value":           describeValue(value),
+		"source":          source,
+		"reason":          reason,
+	}).Info("Override denied by org policy")
+}
+
+// lockProvenance marks the settings locked by the policy in the provenance
+func (p *Policy) lockProvenance(provenance Provenance) {
+	for path, source := range provenance {
+		if p.locks(path) {
+			source.Layer = fmt.Sprintf("%s, locked by policy (%s)", source.Layer, p.file)
+			provenance[path] = source
+		}
+	}
+}
+
+// activePolicy loads the org policy, returning nil if there is none or if it exempts the repository being built
+func (e *Patcher) activePolicy() (*Policy, error) {
+	policy, err := loadPolicy(e.policy)
+	if err != nil || policy == nil {
+		return nil, err
+	}
+	repo := e.repoName()
+	pattern, err := policy.exemption(repo)
+	if err != nil {
+		return nil, err
+	}
+	if pattern != "" {
+		log.WithFields(log.Fields{
+			"sonarscanpolicy": "exempt",
+			"policy":          policy.file,
+			"repo":            repo,
+			"pattern":         pattern,
+		}).Infof("Repository %s is exempt from the org policy", repo)
+		return nil, nil
+	}
+	logger.Debugf("applying org policy '%s' to %s", policy.file, repo)
+	return policy, nil
+}
+
+// repoName returns the owner/name of the repository being built
+func (e *Patcher) repoName() string {
+	return e.getenv(repoOwnerEnv) + "/" + e.getenv(repoNameEnv)
+}
@@ -0,0 +1,168 @@
+package pipeline
+
+import (
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_validatePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{
+			name:    "valid",
+			content: "apiVersion: jx-app-sonar-scanner.jenkins-x.io/v1\nkind: SonarScannerPolicy\nspec:\n  locked: [skip, release.stage, properties.sonar.exclusions]\n  allowed: []\n",
+		},
+		{
+			name:    "empty",
+			content: "",
+			want:    []string{"1:1: expected the file to set 'apiVersion' and 'kind'"},
+		},
+		{
+			name:    "wrong kind",
+			content: "apiVersion: jx-app-sonar-scanner.jenkins-x.io/v1\nkind: SonarScannerConfig\n",
+			want:    []string{"2:7: invalid value 'SonarScannerConfig' for 'kind', expected one of: SonarScannerPolicy"},
+		},
+		{
+			name:    "unknown setting",
+			content: "apiVersion: jx-app-sonar-scanner.jenkins-x.io/v1\nkind: SonarScannerPolicy\nspec:\n  allowed: [verbose, pullrequest]\n",
+			want:    []string{"4:22: unknown setting 'pullrequest' in 'spec.allowed[1]'"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, problem := range validatePolicy([]byte(tt.content)) {
+				got = append(got, problem.String())
+			}
+			if tt.want == nil {
+				tt.want = []string{}
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPolicy_denies(t *testing.T) {
+	policy := &Policy{Locked: []string{"skip", "release.stage"}, Allowed: []string{"verbose", "pullRequest", "release", "skip"}}
+	assert.Equal(t, "", policy.denies("verbose"))
+	assert.Equal(t, "", policy.denies("pullRequest.stage"))
+	assert.Equal(t, "", policy.denies("release.step"))
+	assert.Equal(t, "skip is locked", policy.denies("skip"))
+	assert.Equal(t, "skip is locked", policy.denies("skip.reason"))
+	assert.Equal(t, "release.stage is locked", policy.denies("release.stage"))
+	assert.Equal(t, "release.stage is locked", policy.denies("release"))
+	assert.Equal(t, "feature.stage is not in the allowed settings", policy.denies("feature.stage"))
+
+	assert.Equal(t, "skip is locked, which locks rules as well", policy.denies("rules.skip"))
+	assert.Equal(t, "skip is locked, which locks paths as well", policy.denies("paths"))
+	assert.Equal(t, "skip is locked, which locks rollout as well", policy.denies("rollout"))
+	assert.True(t, policy.locks("paths.include"))
+
+	assert.Equal(t, "", (&Policy{}).denies("feature.stage"))
+	assert.Equal(t, "", (&Policy{Locked: []string{"release"}}).denies("rules.skip"))
+	assert.False(t, (&Policy{Locked: []string{"release"}}).locks("paths.include"))
+	assert.Equal(t, "verbose is not in the allowed settings", (&Policy{Allowed: []string{}}).denies("verbose"))
+}
+
+func TestPatcher_getUserOverrides_policy(t *testing.T) {
+	tests := []struct {
+		name           string
+		env            map[string]string
+		want           UserOverrides
+		wantProvenance map[string]Source
+		wantDenied     []string
+	}{
+		{
+			name: "denied overrides",
+			env: map[string]string{
+				"REPO_OWNER":                         "my-org",
+				"REPO_NAME":                          "my-repo",
+				"SONAR_SCANNER_PULLREQUEST_POSITION": "before",
+				"SONAR_SCANNER_FEATURE_STAGE":        "build",
+				"SONAR_SCANNER_SKIP":                 "true",
+				"SONAR_SCANNER_ROLLOUT":              "0%",
+			},
+			want: UserOverrides{
+				Verbose:     true,
+				PullRequest: BuildSteps{{Stage: "ci", Step: "make-build", Position: PositionBefore}},
+				Release:     BuildSteps{{Position: PositionBefore}},
+				Rules:       SkipRules{Skip: []SkipRule{{Branch: "renovate/*"}}},
+			},
+			wantProvenance: map[string]Source{
+				"verbose":           {"true", "repo (../../test/user-properties/good.yaml)"},
+				"skip":              {"false", "default, locked by policy (../../test/policy/policy.yaml)"},
+				"release.position":  {"before", "org defaults (../../test/org-defaults/defaults.yaml), locked by policy (../../test/policy/policy.yaml)"},
+				"release.stage":     {"", "default, locked by policy (../../test/policy/policy.yaml)"},
+				"feature.stage":     {"", "default"},
+				"pullRequest.stage": {"ci", "repo (../../test/user-properties/good.yaml)"},
+			},
+			wantDenied: []string{"skip", "release.stage", "release.step", "feature.stage", "rollout", "skip"},
+		},
+		{
+			name: "exempt repository",
+			env: map[string]string{
+				"REPO_OWNER":                  "legacy-org",
+				"REPO_NAME":                   "my-repo",
+				"SONAR_SCANNER_FEATURE_STAGE": "build",
+			},
+			want: UserOverrides{
+				Verbose:     true,
+				PullRequest: BuildSteps{{Stage: "ci", Step: "make-build", Position: PositionAfter}},
+				Release:     BuildSteps{{Stage: "release", Step: "make-release", Position: PositionBefore}},
+				Feature:     BuildSteps{{Stage: "build"}},
+				Rules:       SkipRules{Skip: []SkipRule{{Branch: "renovate/*"}}},
+			},
+			wantProvenance: map[string]Source{
+				"release.stage": {"release", "repo (../../test/user-properties/good.yaml)"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := test.NewGlobal()
+			defer hook.Reset()
+			env := tt.env
+			e := &Patcher{
+				sourceDir:   "../../test/user-properties/",
+				orgDefaults: "../../test/org-defaults/defaults.yaml",
+				policy:      "../../test/policy/policy.yaml",
+				env:         func(key string) string { return env[key] },
+			}
+			got, provenance, err := e.getUserOverrides("good.yaml")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			for path, source := range tt.wantProvenance {
+				assert.Equal(t, source, provenance[path], path)
+			}
+
+			denied := []string{}
+			for _, entry := range hook.AllEntries() {
+				if entry.Data["sonarscanpolicy"] == "denied" {
+					assert.Equal(t, log.InfoLevel, entry.Level)
+					assert.Equal(t, "my-org/my-repo", entry.Data["repo"])
+					denied = append(denied, entry.Data["setting"].(string))
+				}
+			}
+			if tt.wantDenied == nil {
+				tt.wantDenied = []string{}
+			}
+			assert.Equal(t, tt.wantDenied, denied)
+		})
+	}
+}
+
+func TestPatcher_getUserOverrides_invalidPolicy(t *testing.T) {
+	e := &Patcher{
+		sourceDir: "../../test/user-properties/",
+		policy:    "../../test/policy/broken.yaml",
+		env:       func(string) string { return "" },
+	}
+	_, _, err := e.getUserOverrides("good.yaml")
+	assert.EqualError(t, err, "unable to parse '../../test/policy/broken.yaml': 6:11: unknown setting 'release.stag' in 'spec.locked[0]'")
+}
@@ -0,0 +1,47 @@
+package pipeline
+
+import (
+	"sort"
+	"strings"
+)
+
+// reservedProperties are set by the scan itself and cannot be overridden
+var reservedProperties = []string{"sonar.host.url", "sonar.login", "sonar.projectKey"}
+
+// properties returns the analysis properties of one scan: its own on top of those shared by every scan
+func (u UserOverrides) properties(scan BuildStep) map[string]string {
+	properties := map[string]string{}
+	for key, value := range u.Properties {
+		properties[key] = value
+	}
+	for key, value := range scan.Properties {
+		properties[key] = value
+	}
+	for _, key := range reservedProperties {
+		if _, ok := properties[key]; ok {
+			logger.Warnf("ignoring property %s of scan %s, it is set by the scan", key, scan.scanName())
+			delete(properties, key)
+		}
+	}
+	return properties
+}
+
+// propertyArgs turns analysis properties into arguments of the scanner script, sorted by key so that
+// reruns produce the same step
+func propertyArgs(properties map[string]string) []string {
+	keys := []string{}
+	for key := range properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	args := []string{}
+	for _, key := range keys {
+		args = append(args, "-d "+shellQuote(key+"="+properties[key]))
+	}
+	return args
+}
+
+// shellQuote quotes s for the shell running the step, so that globs such as **/*.md reach the scanner intact
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,23 @@
+package pipeline
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserOverrides_properties(t *testing.T) {
+	userOverrides := UserOverrides{
+		Properties: map[string]string{"sonar.exclusions": "docs/**", "sonar.sourceEncoding": "UTF-8", "sonar.projectKey": "mine"},
+		Release:    BuildSteps{{Properties: map[string]string{"sonar.exclusions": "docs/**,test/**"}}},
+	}
+	assert.Equal(t, map[string]string{"sonar.exclusions": "docs/**", "sonar.sourceEncoding": "UTF-8"}, userOverrides.properties(BuildStep{}))
+	assert.Equal(t, map[string]string{"sonar.exclusions": "docs/**,test/**", "sonar.sourceEncoding": "UTF-8"}, userOverrides.properties(userOverrides.Release[0]))
+	assert.Equal(t, map[string]string{}, UserOverrides{}.properties(BuildStep{}))
+}
+
+func Test_propertyArgs(t *testing.T) {
+	args := propertyArgs(map[string]string{"sonar.projectName": "It's mine", "sonar.exclusions": "**/*.md"})
+	assert.Equal(t, []string{`-d 'sonar.exclusions=**/*.md'`, `-d 'sonar.projectName=It'\''s mine'`}, args)
+	assert.Empty(t, propertyArgs(nil))
+}
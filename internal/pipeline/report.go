@@ -0,0 +1,173 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// Output formats for the report of a run
+const (
+	// OutputText reports progress through the log only, this is the default
+	OutputText = "text"
+	// OutputJSON additionally prints the insertion decisions as JSON
+	OutputJSON = "json"
+)
+
+// Actions taken on a pipeline
+const (
+	// ActionInsert means a new scan step was added
+	ActionInsert = "insert"
+	// ActionUpdate means an existing scan step was updated in place
+	ActionUpdate = "update"
+	// ActionSkip means the pipeline was left without a scan
+	ActionSkip = "skip"
+)
+
+// Decision records where, and whether, a scan was placed in one pipeline. Scan names the scan when the
+// pipeline has several. Detection is set when the build pack was guessed from the source tree.
+// Stage and step lines refer to the original pipeline, scan and env lines to the patched one.
+type Decision struct {
+	Context   string `json:"context,omitempty"`
+	Pipeline  string `json:"pipeline"`
+	Scan      string `json:"scan,omitempty"`
+	Action    string `json:"action"`
+	Reason    string `json:"reason,omitempty"`
+	Position  string `json:"position,omitempty"`
+	Stage     string `json:"stage,omitempty"`
+	StageLine int    `json:"stageLine,omitempty"`
+	Step      string `json:"step,omitempty"`
+	StepLine  int    `json:"stepLine,omitempty"`
+	ScanLine  int    `json:"scanLine,omitempty"`
+	EnvLine   int    `json:"envLine,omitempty"`
+	// Discovered names the rule that found the anchor among the commands of the steps
+	Discovered string `json:"discovered,omitempty"`
+
+	Detection *Detection `json:"detection,omitempty"`
+}
+
+// decide starts the record of the decision taken for a pipeline
+func (e *Patcher) decide(pipeline string) *Decision {
+	decision := &Decision{Context: e.context, Pipeline: pipeline, Action: ActionSkip}
+	e.decisions = append(e.decisions, decision)
+	return decision
+}
+
+// describeAnchor records where the scan is placed, and the lines of the stage and step when they were found
+func (d *Decision) describeAnchor(anchor BuildStep, stage *Stage, step *Step) {
+	d.Stage = anchor.Stage
+	d.Position = anchor.Position
+	d.Step = ""
+	if anchor.needsStep() {
+		d.Step = anchor.Step
+	}
+	if stage != nil {
+		d.StageLine = stage.Line()
+	}
+	if step != nil {
+		d.StepLine = step.Line()
+	}
+}
+
+// locateDecisions fills in the lines at which the scan and the buildpack name ended up in the patched pipeline
+// of the current context
+func (e *Patcher) locateDecisions(patched []byte) error {
+	config, err := ParseProjectConfig(patched)
+	if err != nil {
+		return errors.Wrap(err, "unable to parse patched pipeline")
+	}
+	for _, decision := range e.decisions {
+		if decision.Context != e.context || decision.Action == ActionSkip {
+			continue
+		}
+		targetPipeline := config.Pipeline(decision.Pipeline)
+		if targetPipeline == nil {
+			continue
+		}
+		steps := findScannerSteps(targetPipeline)
+		if decision.Scan != "" {
+			steps = stepsNamed(steps, decision.Scan)
+		}
+		if len(steps) > 0 {
+			decision.ScanLine = steps[0].Line()
+		}
+		env := targetPipeline.EnvVars()
+		if env == nil && config.PipelineConfig != nil {
+			env = config.PipelineConfig.Env
+		}
+		if env != nil {
+			if v := env.Get("BUILDPACK_NAME"); v != nil {
+				decision.EnvLine = v.Line()
+			}
+		}
+	}
+	return nil
+}
+
+// writeDecisions prints the insertion decisions as JSON
+func writeDecisions(out io.Writer, decisions []*Decision) error {
+	content, err := json.MarshalIndent(decisions, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "unable to serialise insertion decisions")
+	}
+	_, err = fmt.Fprintln(out, string(content))
+	return err
+}
+
+// writeDiff prints a unified diff between the original and patched pipeline
+func writeDiff(out io.Writer, path string, original []byte, patched []byte) error {
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(original)),
+		B:        difflib.SplitLines(string(patched)),
+		FromFile: "a/" + path,
+		ToFile:   "b/" + path,
+		Context:  3,
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to compute diff")
+	}
+	_, err = io.WriteString(out, diff)
+	return err
+}
+
+// summarise prints which contexts were patched and which were skipped, and why
+func (e *Patcher) summarise(contexts []string, failures map[string]error) {
+	if e.output != OutputText {
+		return
+	}
+	patched := "patched"
+	if e.dryRun {
+		patched = "would patch"
+	}
+	w := tabwriter.NewWriter(e.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTEXT\tFILE\tRESULT\tDETAILS")
+	for _, context := range contexts {
+		name := context
+		if name == "" {
+			name = "default"
+		}
+		result, details := "skipped", []string{}
+		if err, failed := failures[context]; failed {
+			result, details = "failed", []string{err.Error()}
+		} else {
+			for _, decision := range e.decisions {
+				if decision.Context != context {
+					continue
+				}
+				if decision.Action == ActionSkip {
+					details = append(details, fmt.Sprintf("%s: %s", decision.Pipeline, decision.Reason))
+				} else {
+					result = patched
+					details = append(details, fmt.Sprintf("%s: %s", decision.Pipeline, decision.Action))
+				}
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", name, effectiveConfigFile(context), result, strings.Join(details, ", "))
+	}
+	_ = w.Flush()
+}
@@ -0,0 +1,117 @@
+package pipeline
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Rollout enables the scan for part of the repositories only, so that it can be turned on gradually. It is
+// given either as a percentage, such as 25%, or as a percentage and a list of orgs.
+type Rollout struct {
+	// Percentage is the share of repositories scanned, chosen by a stable hash of their owner/name
+	Percentage string `yaml:"percentage,omitempty"`
+	// Orgs lists shell patterns of the repository owners scanned whatever the percentage
+	Orgs []string `yaml:"orgs,omitempty"`
+}
+
+// UnmarshalYAML reads a rollout given either as a percentage or as a mapping
+func (r *Rollout) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&r.Percentage)
+	}
+	type rollout Rollout
+	return node.Decode((*rollout)(r))
+}
+
+// empty reports whether the rollout covers every repository
+func (r Rollout) empty() bool {
+	return r.Percentage == "" && len(r.Orgs) == 0
+}
+
+// parsePercentage reads a whole percentage between 0% and 100%
+func parsePercentage(value string) (int, error) {
+	percentage, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+	if err != nil || !strings.HasSuffix(value, "%") || percentage < 0 || percentage > 100 {
+		return 0, errors.Errorf("invalid percentage '%s', expected 0%% to 100%%", value)
+	}
+	return percentage, nil
+}
+
+// bucket places a repository in one of 100 buckets. The same repository always lands in the same bucket,
+// so that raising the percentage only ever adds repositories.
+func bucket(repo string) int {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(repo))
+	return int(hash.Sum32() % 100)
+}
+
+// includes decides whether the repository owner/name is part of the rollout, and why
+func (r Rollout) includes(owner string, name string) (bool, string, error) {
+	if r.empty() {
+		return true, "", nil
+	}
+	for _, pattern := range r.Orgs {
+		matched, err := path.Match(pattern, owner)
+		if err != nil {
+			return false, "", errors.Wrapf(err, "invalid rollout org pattern '%s'", pattern)
+		}
+		if matched {
+			return true, fmt.Sprintf("org %s matches %s", owner, pattern), nil
+		}
+	}
+	repo := owner + "/" + name
+	if r.Percentage == "" {
+		return false, fmt.Sprintf("%s is not in the rollout orgs", repo), nil
+	}
+	percentage, err := parsePercentage(r.Percentage)
+	if err != nil {
+		return false, "", err
+	}
+	b := bucket(repo)
+	if b < percentage {
+		return true, fmt.Sprintf("%s is in bucket %d, below %d%%", repo, b, percentage), nil
+	}
+	return false, fmt.Sprintf("%s is not yet in the rollout: bucket %d, rollout %d%%", repo, b, percentage), nil
+}
+
+// applyRollout decides whether the repository being built is left out of the rollout, logging the decision.
+// A repository that cannot be identified is scanned.
+func (e *Patcher) applyRollout(rollout Rollout) (bool, string, error) {
+	if rollout.empty() {
+		return false, "", nil
+	}
+	owner, name := e.getenv(repoOwnerEnv), e.getenv(repoNameEnv)
+	if owner == "" || name == "" {
+		log.WithFields(log.Fields{
+			"sonarscanrollout": true,
+			"sonarscanskip":    false,
+			"percentage":       rollout.Percentage,
+			"orgs":             strings.Join(rollout.Orgs, ","),
+		}).Warnf("Scanning as the repository is not known to the rollout: %s and %s must both be set", repoOwnerEnv, repoNameEnv)
+		return false, "", nil
+	}
+	included, reason, err := rollout.includes(owner, name)
+	if err != nil {
+		return false, "", err
+	}
+	entry := log.WithFields(log.Fields{
+		"sonarscanrollout": included,
+		"sonarscanskip":    !included,
+		"repo":             owner + "/" + name,
+		"percentage":       rollout.Percentage,
+		"orgs":             strings.Join(rollout.Orgs, ","),
+	})
+	if included {
+		entry.Infof("Scanning as part of the rollout: %s", reason)
+		return false, "", nil
+	}
+	entry.Warnf("Skipping sonar scan as the repository is left out of the rollout: %s", reason)
+	return true, reason, nil
+}
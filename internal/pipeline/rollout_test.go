@@ -0,0 +1,156 @@
+package pipeline
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	jxutil "github.com/jenkins-x/jx/v2/pkg/util"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/udhos/equalfile"
+	yaml "gopkg.in/yaml.v3"
+)
+
+func TestRollout_UnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    Rollout
+	}{
+		{"percentage", "rollout: 25%", Rollout{Percentage: "25%"}},
+		{"mapping", "rollout: {percentage: 10%, orgs: [platform, team-*]}", Rollout{Percentage: "10%", Orgs: []string{"platform", "team-*"}}},
+		{"not set", "verbose: true", Rollout{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userOverrides := UserOverrides{}
+			err := yaml.Unmarshal([]byte(tt.content), &userOverrides)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, userOverrides.Rollout)
+		})
+	}
+}
+
+func Test_bucket(t *testing.T) {
+	// Buckets must not change between releases, or repositories would drop out of a rollout
+	assert.Equal(t, 46, bucket("my-org/my-repo"))
+	assert.Equal(t, 1, bucket("my-org/other"))
+	assert.Equal(t, 89, bucket("platform/api"))
+}
+
+func TestRollout_includes(t *testing.T) {
+	tests := []struct {
+		name         string
+		rollout      Rollout
+		owner        string
+		repo         string
+		wantIncluded bool
+		wantReason   string
+		wantErr      bool
+	}{
+		{"no rollout", Rollout{}, "my-org", "my-repo", true, "", false},
+		{"below percentage", Rollout{Percentage: "50%"}, "my-org", "my-repo", true, "my-org/my-repo is in bucket 46, below 50%", false},
+		{"above percentage", Rollout{Percentage: "25%"}, "my-org", "my-repo", false, "my-org/my-repo is not yet in the rollout: bucket 46, rollout 25%", false},
+		{"everyone", Rollout{Percentage: "100%"}, "platform", "api", true, "platform/api is in bucket 89, below 100%", false},
+		{"nobody", Rollout{Percentage: "0%"}, "my-org", "other", false, "my-org/other is not yet in the rollout: bucket 1, rollout 0%", false},
+		{"allowed org", Rollout{Percentage: "0%", Orgs: []string{"plat*"}}, "platform", "api", true, "org platform matches plat*", false},
+		{"other org", Rollout{Orgs: []string{"platform"}}, "my-org", "my-repo", false, "my-org/my-repo is not in the rollout orgs", false},
+		{"invalid percentage", Rollout{Percentage: "half"}, "my-org", "my-repo", false, "", true},
+		{"invalid org pattern", Rollout{Orgs: []string{"["}}, "my-org", "my-repo", false, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			included, reason, err := tt.rollout.includes(tt.owner, tt.repo)
+			assert.Equal(t, tt.wantErr, err != nil, "error %v", err)
+			assert.Equal(t, tt.wantIncluded, included)
+			assert.Equal(t, tt.wantReason, reason)
+		})
+	}
+}
+
+func Test_parsePercentage(t *testing.T) {
+	percentage, err := parsePercentage("25%")
+	assert.NoError(t, err)
+	assert.Equal(t, 25, percentage)
+
+	for _, value := range []string{"25", "-1%", "101%", "12.5%", "%"} {
+		_, err := parsePercentage(value)
+		assert.EqualError(t, err, "invalid percentage '"+value+"', expected 0% to 100%")
+	}
+}
+
+func TestPatcher_ConfigurePipeline_rollout(t *testing.T) {
+	repo := map[string]string{"REPO_OWNER": "my-org", "REPO_NAME": "my-repo"}
+	tests := []struct {
+		name        string
+		repoFile    string
+		orgDefaults string
+		env         map[string]string
+		want        string
+		reason      string
+		wantLevel   log.Level
+	}{
+		// A repository cannot set its own rollout, the file is invalid
+		{"repo rollout", "rollout:\n    percentage: 0%\n", "", repo, "jenkins-x-effective.yml", "invalid .jx-app-sonar-scanner.yaml", log.WarnLevel},
+		{"org defaults rollout", "", "../../test/org-defaults/rollout.yaml", repo, "jenkins-x-effective.yml", "my-org/my-repo is not yet in the rollout: bucket 46, rollout 0%", log.WarnLevel},
+		{"env rollout", "", "", map[string]string{"REPO_OWNER": "my-org", "REPO_NAME": "my-repo", "SONAR_SCANNER_ROLLOUT": "0%"}, "jenkins-x-effective.yml", "my-org/my-repo is not yet in the rollout: bucket 46, rollout 0%", log.WarnLevel},
+		{"env rollout including the repo", "", "", map[string]string{"REPO_OWNER": "my-org", "REPO_NAME": "my-repo", "SONAR_SCANNER_ROLLOUT": "50%"}, "jenkins-x-effective.gold.yml", "", log.InfoLevel},
+		{"unknown repository", "", "", map[string]string{"SONAR_SCANNER_ROLLOUT": "0%"}, "jenkins-x-effective.gold.yml", "", log.WarnLevel},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := test.NewGlobal()
+			defer hook.Reset()
+			dir, err := ioutil.TempDir("../../test/", "rollout-go")
+			assert.NoError(t, err)
+			defer func() {
+				err := os.RemoveAll(dir)
+				assert.NoError(t, err)
+			}()
+			err = jxutil.CopyDir("../../test/go-rollout", dir, true)
+			assert.NoError(t, err)
+			if tt.repoFile != "" {
+				err = ioutil.WriteFile(filepath.Join(dir, userOverridesFile), []byte(tt.repoFile), 0600)
+				assert.NoError(t, err)
+			}
+
+			e := NewPatcher(dir, "", "http://jx-sonarqube.sonarqube.svc.cluster.local:9000", "12345", true, true, false)
+			e.env = func(key string) string { return tt.env[key] }
+			e.SetOrgDefaults(tt.orgDefaults)
+			err = e.ConfigurePipeline()
+			assert.NoError(t, err)
+
+			equal, err := equalfile.New(nil, equalfile.Options{}).CompareFile(filepath.Join(dir, "jenkins-x-effective.yml"), filepath.Join("../../test/go-rollout", tt.want))
+			assert.NoError(t, err)
+			assert.True(t, equal, "pipeline files don't match")
+			for _, decision := range e.decisions {
+				assert.Equal(t, tt.reason, decision.Reason)
+			}
+
+			var entry *log.Entry
+			rejected := false
+			for _, logged := range hook.AllEntries() {
+				if _, ok := logged.Data["sonarscanrollout"]; ok {
+					entry = logged
+				}
+				if strings.HasSuffix(logged.Message, "1:1: unknown field 'rollout', the rollout is only read from the org defaults or the environment") {
+					assert.Equal(t, log.ErrorLevel, logged.Level)
+					rejected = true
+				}
+			}
+			assert.Equal(t, tt.repoFile != "", rejected, "the rollout of the repo override file is not rejected")
+			if tt.repoFile != "" {
+				assert.Nil(t, entry)
+				return
+			}
+			if assert.NotNil(t, entry) {
+				assert.Equal(t, tt.wantLevel, entry.Level)
+				assert.Equal(t, tt.reason != "", entry.Data["sonarscanskip"])
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package pipeline
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Environment variables describing the build, as set by Jenkins X
+const (
+	pipelineKindEnv = "PIPELINE_KIND"
+	branchNameEnv   = "BRANCH_NAME"
+	pullBaseRefEnv  = "PULL_BASE_REF"
+	repoOwnerEnv    = "REPO_OWNER"
+	repoNameEnv     = "REPO_NAME"
+)
+
+// SkipRules decides from the build environment whether a repository should be scanned
+type SkipRules struct {
+	Skip []SkipRule `yaml:"skip,omitempty"`
+	Only []SkipRule `yaml:"only,omitempty"`
+}
+
+// SkipRule matches the build environment when every pattern it sets matches. Patterns are shell globs.
+type SkipRule struct {
+	Kind       string `yaml:"kind,omitempty"`
+	Branch     string `yaml:"branch,omitempty"`
+	BaseBranch string `yaml:"baseBranch,omitempty"`
+}
+
+// matches reports whether the rule matches the build environment
+func (r SkipRule) matches(getenv func(string) string) (bool, error) {
+	patterns := []struct {
+		pattern string
+		env     string
+	}{
+		{r.Kind, pipelineKindEnv},
+		{r.Branch, branchNameEnv},
+		{r.BaseBranch, pullBaseRefEnv},
+	}
+	for _, p := range patterns {
+		if p.pattern == "" {
+			continue
+		}
+		matched, err := path.Match(p.pattern, getenv(p.env))
+		if err != nil {
+			return false, errors.Wrapf(err, "invalid pattern '%s' in rule %s", p.pattern, r)
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (r SkipRule) String() string {
+	fields := []string{}
+	if r.Kind != "" {
+		fields = append(fields, "kind="+r.Kind)
+	}
+	if r.Branch != "" {
+		fields = append(fields, "branch="+r.Branch)
+	}
+	if r.BaseBranch != "" {
+		fields = append(fields, "baseBranch="+r.BaseBranch)
+	}
+	return "{" + strings.Join(fields, " ") + "}"
+}
+
+// evaluate decides whether the build described by the environment should be skipped, and why
+func (r SkipRules) evaluate(getenv func(string) string) (bool, string, error) {
+	for _, rule := range r.Skip {
+		matched, err := rule.matches(getenv)
+		if err != nil {
+			return false, "", err
+		}
+		if matched {
+			return true, fmt.Sprintf("skip rule %s matched", rule), nil
+		}
+	}
+	if len(r.Only) == 0 {
+		return false, "no skip rule matched", nil
+	}
+	for _, rule := range r.Only {
+		matched, err := rule.matches(getenv)
+		if err != nil {
+			return false, "", err
+		}
+		if matched {
+			return false, fmt.Sprintf("only rule %s matched", rule), nil
+		}
+	}
+	return true, "no only rule matched", nil
+}
+
+// applySkipRules evaluates the skip rules of the user overrides against the build environment and logs the decision
+func (e *Patcher) applySkipRules(rules SkipRules) (bool, string, error) {
+	if len(rules.Skip) == 0 && len(rules.Only) == 0 {
+		return false, "", nil
+	}
+	skip, reason, err := rules.evaluate(e.getenv)
+	if err != nil {
+		return false, "", errors.Wrap(err, "unable to evaluate skip rules")
+	}
+	entry := log.WithFields(log.Fields{
+		"sonarscanskip": skip,
+		"pipelinekind":  e.getenv(pipelineKindEnv),
+		"branch":        e.getenv(branchNameEnv),
+		"basebranch":    e.getenv(pullBaseRefEnv),
+		"rule":          reason,
+	})
+	if skip {
+		entry.Warn("Skipping sonar scan due to developer skip rules")
+	} else {
+		entry.Info("Sonar scan allowed by developer skip rules")
+	}
+	return skip, reason, nil
+}
+
+// getenv looks up a variable of the build environment
+func (e *Patcher) getenv(key string) string {
+	if e.env != nil {
+		return e.env(key)
+	}
+	return os.Getenv(key)
+}
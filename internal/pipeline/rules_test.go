@@ -0,0 +1,49 @@
+package pipeline
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkipRules_evaluate(t *testing.T) {
+	prFromRenovate := map[string]string{"PIPELINE_KIND": "pullrequest", "BRANCH_NAME": "renovate/golang-1.x", "PULL_BASE_REF": "main"}
+	releaseOnMain := map[string]string{"PIPELINE_KIND": "release", "BRANCH_NAME": "main", "PULL_BASE_REF": "main"}
+	releaseOnBranch := map[string]string{"PIPELINE_KIND": "release", "BRANCH_NAME": "release/1.2", "PULL_BASE_REF": "release/1.2"}
+	featureBuild := map[string]string{"PIPELINE_KIND": "feature", "BRANCH_NAME": "feature/login"}
+
+	skipBots := SkipRules{Skip: []SkipRule{{Branch: "renovate/*"}, {Branch: "dependabot/*"}}}
+	skipPullRequests := SkipRules{Skip: []SkipRule{{Kind: "pullrequest"}}}
+	onlyMainAndReleases := SkipRules{Only: []SkipRule{{BaseBranch: "main"}, {BaseBranch: "release/*"}}}
+	skipReleasesOnBranches := SkipRules{Skip: []SkipRule{{Kind: "release", Branch: "release/*"}}}
+
+	tests := []struct {
+		name       string
+		rules      SkipRules
+		env        map[string]string
+		wantSkip   bool
+		wantReason string
+		wantErr    bool
+	}{
+		{"no rules", SkipRules{}, prFromRenovate, false, "no skip rule matched", false},
+		{"bot branch", skipBots, prFromRenovate, true, "skip rule {branch=renovate/*} matched", false},
+		{"other branch", skipBots, releaseOnMain, false, "no skip rule matched", false},
+		{"pull requests", skipPullRequests, prFromRenovate, true, "skip rule {kind=pullrequest} matched", false},
+		{"not a pull request", skipPullRequests, releaseOnMain, false, "no skip rule matched", false},
+		{"only main", onlyMainAndReleases, releaseOnMain, false, "only rule {baseBranch=main} matched", false},
+		{"only release branches", onlyMainAndReleases, releaseOnBranch, false, "only rule {baseBranch=release/*} matched", false},
+		{"not in only", onlyMainAndReleases, featureBuild, true, "no only rule matched", false},
+		{"all patterns must match", skipReleasesOnBranches, releaseOnMain, false, "no skip rule matched", false},
+		{"all patterns match", skipReleasesOnBranches, releaseOnBranch, true, "skip rule {kind=release branch=release/*} matched", false},
+		{"skip wins over only", SkipRules{Skip: skipBots.Skip, Only: onlyMainAndReleases.Only}, prFromRenovate, true, "skip rule {branch=renovate/*} matched", false},
+		{"invalid pattern", SkipRules{Skip: []SkipRule{{Branch: "["}}}, releaseOnMain, false, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			skip, reason, err := tt.rules.evaluate(func(key string) string { return tt.env[key] })
+			assert.Equal(t, tt.wantErr, err != nil, "error = %v", err)
+			assert.Equal(t, tt.wantSkip, skip)
+			assert.Equal(t, tt.wantReason, reason)
+		})
+	}
+}
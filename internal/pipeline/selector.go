@@ -0,0 +1,240 @@
+package pipeline
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/jenkins-x-apps/jx-app-sonar-scanner/internal/util"
+	"github.com/pkg/errors"
+)
+
+const (
+	globPrefix  = "glob:"
+	regexPrefix = "regex:"
+
+	stagePathSeparator = "/"
+
+	// regexMetaCharacters are the characters that only a regular expression would hold
+	regexMetaCharacters = `^$()[]{}*+?|\`
+)
+
+// selector matches the names of stages and steps. A plain name has to match exactly,
+// a name prefixed with glob: is matched as a shell pattern and one prefixed with regex:
+// as a regular expression.
+type selector struct {
+	expr  string
+	match func(name string) bool
+}
+
+// newSelector parses a stage or step selector
+func newSelector(expr string) (selector, error) {
+	switch {
+	case strings.HasPrefix(expr, globPrefix):
+		pattern := strings.TrimPrefix(expr, globPrefix)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return selector{}, errors.Wrapf(err, "invalid glob '%s'", pattern)
+		}
+		return selector{expr: expr, match: func(name string) bool {
+			matched, _ := path.Match(pattern, name)
+			return matched
+		}}, nil
+	case strings.HasPrefix(expr, regexPrefix):
+		re, err := regexp.Compile(strings.TrimPrefix(expr, regexPrefix))
+		if err != nil {
+			return selector{}, errors.Wrapf(err, "invalid regex '%s'", strings.TrimPrefix(expr, regexPrefix))
+		}
+		return selector{expr: expr, match: re.MatchString}, nil
+	default:
+		return selector{expr: expr, match: func(name string) bool {
+			return name == expr
+		}}, nil
+	}
+}
+
+func (s selector) String() string {
+	return s.expr
+}
+
+// stageSelector matches a stage by its path, such as build/verify/unit. The last segment selects the
+// stage itself and each earlier segment one of its enclosing stages, nearest last, so a single
+// segment selects a stage at any depth. Each segment is an independent selector.
+type stageSelector []selector
+
+// newStageSelector parses a stage path into its segments. As / separates the segments, a regex: segment
+// cannot contain one. A segment that follows a regex: segment without a prefix of its own but with the
+// characters of a regular expression is taken for the rest of a regex cut at a /, and rejected.
+func newStageSelector(expr string) (stageSelector, error) {
+	sel := stageSelector{}
+	afterRegex := false
+	for _, segment := range strings.Split(expr, stagePathSeparator) {
+		if segment == "" {
+			return nil, errors.Errorf("invalid stage path '%s'", expr)
+		}
+		if afterRegex && !strings.HasPrefix(segment, globPrefix) && !strings.HasPrefix(segment, regexPrefix) && strings.ContainsAny(segment, regexMetaCharacters) {
+			return nil, errors.Errorf("invalid stage path '%s': a regex cannot contain %s, give each stage its own segment such as regex:^build$/regex:^unit", expr, stagePathSeparator)
+		}
+		afterRegex = strings.HasPrefix(segment, regexPrefix)
+		s, err := newSelector(segment)
+		if err != nil {
+			return nil, err
+		}
+		sel = append(sel, s)
+	}
+	return sel, nil
+}
+
+// match reports whether the stage, nested within parents, is selected
+func (s stageSelector) match(stage *Stage, parents []*Stage) bool {
+	if len(s) > len(parents)+1 {
+		return false
+	}
+	path := append(append([]*Stage{}, parents...), stage)
+	path = path[len(path)-len(s):]
+	for i, segment := range s {
+		if !segment.match(path[i].Name) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s stageSelector) String() string {
+	segments := []string{}
+	for _, segment := range s {
+		segments = append(segments, segment.String())
+	}
+	return strings.Join(segments, stagePathSeparator)
+}
+
+// findStage finds the single stage of the pipeline selected by sel, at any depth, or nil if there is none
+func findStage(pipeline *ParsedPipeline, sel stageSelector) (*Stage, error) {
+	matches := []*Stage{}
+	candidates := []string{}
+	pipeline.WalkStages(func(stage *Stage, parents []*Stage) bool {
+		if sel.match(stage, parents) {
+			matches = append(matches, stage)
+			candidates = append(candidates, fmt.Sprintf("%s (line %d)", stagePath(stage, parents), stage.Line()))
+		}
+		return true
+	})
+	if len(matches) > 1 {
+		return nil, errors.Errorf("stage selector '%s' is ambiguous, it matches: %s", sel, strings.Join(candidates, ", "))
+	}
+	if len(matches) == 0 {
+		return nil, nil
+	}
+	return matches[0], nil
+}
+
+// stagePath returns the full path of a stage nested within parents
+func stagePath(stage *Stage, parents []*Stage) string {
+	names := []string{}
+	for _, parent := range parents {
+		names = append(names, parent.Name)
+	}
+	return strings.Join(append(names, stage.Name), stagePathSeparator)
+}
+
+// legacySuggestion helps a plain name written for the loose matching of earlier releases, in which a
+// stage or step was selected when its name merely contained the value, as stage: build did for
+// from-build-pack. It returns a hint naming the stages or steps that the value would have selected then, or
+// an empty string if it would have selected none.
+func legacySuggestion(expr string, names []string) string {
+	if !isPlainName(expr) {
+		return ""
+	}
+	candidates := []string{}
+	for _, name := range names {
+		if name != expr && strings.Contains(name, expr) && !util.Contains(candidates, "'"+name+"'") {
+			candidates = append(candidates, "'"+name+"'")
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("names are matched exactly, did you mean %s?", strings.Join(candidates, " or "))
+}
+
+// isPlainName reports whether a stage or step selector is a single name, without a prefix or a path
+func isPlainName(expr string) bool {
+	return expr != "" && !strings.HasPrefix(expr, globPrefix) && !strings.HasPrefix(expr, regexPrefix) && !strings.Contains(expr, stagePathSeparator)
+}
+
+// findStageLoosely finds the stage selected by a plain name the way earlier releases did, that is the
+// stage whose name contains it, or nil if there is no such stage or more than one
+func findStageLoosely(pipeline *ParsedPipeline, expr string) *Stage {
+	if !isPlainName(expr) {
+		return nil
+	}
+	matches := []*Stage{}
+	pipeline.WalkStages(func(stage *Stage, parents []*Stage) bool {
+		if strings.Contains(stage.Name, expr) {
+			matches = append(matches, stage)
+		}
+		return true
+	})
+	if len(matches) != 1 {
+		return nil
+	}
+	return matches[0]
+}
+
+// findStepLoosely finds the step selected by a plain name the way earlier releases did, that is the step
+// whose name contains it, or nil if there is no such step or more than one
+func findStepLoosely(steps []*Step, expr string) *Step {
+	if !isPlainName(expr) {
+		return nil
+	}
+	matches := []*Step{}
+	for _, step := range steps {
+		if strings.Contains(step.Name, expr) {
+			matches = append(matches, step)
+		}
+	}
+	if len(matches) != 1 {
+		return nil
+	}
+	return matches[0]
+}
+
+// stageNames returns the names of every stage of the pipeline
+func stageNames(pipeline *ParsedPipeline) []string {
+	names := []string{}
+	pipeline.WalkStages(func(stage *Stage, parents []*Stage) bool {
+		names = append(names, stage.Name)
+		return true
+	})
+	return names
+}
+
+// stepNames returns the names of the steps
+func stepNames(steps []*Step) []string {
+	names := []string{}
+	for _, step := range steps {
+		names = append(names, step.Name)
+	}
+	return names
+}
+
+// findStep finds the single step selected by sel, or nil if there is none
+func findStep(steps []*Step, sel selector) (*Step, error) {
+	matches := []*Step{}
+	for _, step := range steps {
+		if sel.match(step.Name) {
+			matches = append(matches, step)
+		}
+	}
+	if len(matches) > 1 {
+		candidates := []string{}
+		for _, step := range matches {
+			candidates = append(candidates, fmt.Sprintf("%s (line %d)", step.Name, step.Line()))
+		}
+		return nil, errors.Errorf("step selector '%s' is ambiguous, it matches: %s", sel, strings.Join(candidates, ", "))
+	}
+	if len(matches) == 0 {
+		return nil, nil
+	}
+	return matches[0], nil
+}
@@ -0,0 +1,119 @@
+package pipeline
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newSelector(t *testing.T) {
+	tests := []struct {
+		expr    string
+		name    string
+		want    bool
+		wantErr bool
+	}{
+		{"build-make-linux", "build-make-linux", true, false},
+		{"build-make-linux", "build-make-linux-arm", false, false},
+		{"build", "from-build-pack", false, false},
+		{"glob:build-make-*", "build-make-linux-arm", true, false},
+		{"glob:build-make-?", "build-make-linux", false, false},
+		{"glob:[", "build", false, true},
+		{"regex:^build-(make|mvn)-", "build-mvn-install", true, false},
+		{"regex:^build-(make|mvn)-", "from-build-pack", false, false},
+		{"regex:(", "build", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr+"/"+tt.name, func(t *testing.T) {
+			sel, err := newSelector(tt.expr)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, sel.match(tt.name))
+			assert.Equal(t, tt.expr, sel.String())
+		})
+	}
+}
+
+func Test_findStep(t *testing.T) {
+	steps := []*Step{
+		NewStep("build-make-linux-arm", "make", nil, "go"),
+		NewStep("build-make-linux", "make", nil, "go"),
+	}
+
+	sel, _ := newSelector("build-make-linux")
+	step, err := findStep(steps, sel)
+	assert.NoError(t, err)
+	assert.Equal(t, steps[1], step)
+
+	sel, _ = newSelector("build-make-windows")
+	step, err = findStep(steps, sel)
+	assert.NoError(t, err)
+	assert.Nil(t, step)
+
+	sel, _ = newSelector("glob:build-make-*")
+	_, err = findStep(steps, sel)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "build-make-linux-arm")
+	assert.Contains(t, err.Error(), "build-make-linux (line")
+}
+
+func Test_findStage(t *testing.T) {
+	config, err := LoadProjectConfig("../../test/go-nested-stages/jenkins-x-effective.yml")
+	assert.NoError(t, err)
+	pipeline := config.Pipeline("pullRequest")
+
+	tests := []struct {
+		expr    string
+		want    int
+		wantErr bool
+	}{
+		{"build/verify/unit", 22, false},
+		{"verify/unit", 22, false},
+		{"integration/unit", 36, false},
+		{"lint", 28, false},
+		{"build", 12, false},
+		{"glob:*/unit", 0, true},
+		{"unit", 0, true},
+		{"compile/unit", 0, false},
+		{"build//unit", 0, true},
+		{"regex:^build$/regex:^verify$/unit", 22, false},
+		{"regex:^build/verify$", 0, true},
+		{"regex:^build/(verify|test)/unit$", 0, true},
+		{"regex:^verify$/unit", 22, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			sel, err := newStageSelector(tt.expr)
+			if err == nil {
+				var stage *Stage
+				stage, err = findStage(pipeline, sel)
+				if stage != nil {
+					assert.Equal(t, tt.want, stage.Line())
+				} else {
+					assert.Equal(t, 0, tt.want)
+				}
+			}
+			assert.Equal(t, tt.wantErr, err != nil, "error = %v", err)
+		})
+	}
+}
+
+func Test_legacySuggestion(t *testing.T) {
+	assert.Equal(t, "names are matched exactly, did you mean 'from-build-pack'?", legacySuggestion("build", []string{"from-build-pack", "promote"}))
+	assert.Equal(t, "names are matched exactly, did you mean 'build-make-linux' or 'build-make-linux-arm'?", legacySuggestion("make-linux", []string{"build-make-linux", "build-make-linux-arm"}))
+	assert.Equal(t, "", legacySuggestion("deploy", []string{"from-build-pack"}))
+	assert.Equal(t, "", legacySuggestion("glob:build", []string{"from-build-pack"}))
+	assert.Equal(t, "", legacySuggestion("pack/build", []string{"from-build-pack"}))
+}
+
+func Test_findStepLoosely(t *testing.T) {
+	steps := []*Step{{Name: "build-make-linux"}, {Name: "build-make-linux-arm"}, {Name: "build-container-build"}}
+
+	assert.Equal(t, steps[2], findStepLoosely(steps, "container"))
+	assert.Nil(t, findStepLoosely(steps, "make-linux"), "more than one step contains the name")
+	assert.Nil(t, findStepLoosely(steps, "deploy"))
+	assert.Nil(t, findStepLoosely(steps, "glob:container"))
+}
@@ -0,0 +1,88 @@
+package pipeline
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v3"
+)
+
+const (
+	// dateFormat is the layout of dates in the user overrides file
+	dateFormat = "2006-01-02"
+)
+
+// Skip turns the scan of a repository off. It is given either as true or false, or as an exemption
+// recording why the repository is not scanned, who answers for it and until when.
+type Skip struct {
+	Enabled bool   `yaml:"-"`
+	Reason  string `yaml:"reason,omitempty"`
+	Ticket  string `yaml:"ticket,omitempty"`
+	Owner   string `yaml:"owner,omitempty"`
+	Until   string `yaml:"until,omitempty"`
+}
+
+// UnmarshalYAML reads a skip given either as a boolean or as an exemption
+func (s *Skip) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&s.Enabled)
+	}
+	type exemption Skip
+	err := node.Decode((*exemption)(s))
+	if err != nil {
+		return err
+	}
+	s.Enabled = true
+	return nil
+}
+
+// expired reports whether the exemption ended before the given time. The day named by until is still covered.
+func (s Skip) expired(now time.Time) (bool, error) {
+	if s.Until == "" {
+		return false, nil
+	}
+	until, err := time.Parse(dateFormat, s.Until)
+	if err != nil {
+		return false, errors.Wrapf(err, "invalid skip until date '%s'", s.Until)
+	}
+	return !now.UTC().Before(until.AddDate(0, 0, 1)), nil
+}
+
+// applySkip decides whether the user overrides turn the scan off, logging the exemption so that it can be
+// audited. An exemption past its until date is ignored with a warning.
+func (e *Patcher) applySkip(skip Skip) (bool, string, error) {
+	if !skip.Enabled {
+		return false, "", nil
+	}
+	expired, err := skip.expired(e.clock())
+	if err != nil {
+		return false, "", err
+	}
+	entry := log.WithFields(log.Fields{
+		"sonarscanskip": !expired,
+		"reason":        skip.Reason,
+		"ticket":        skip.Ticket,
+		"owner":         skip.Owner,
+		"until":         skip.Until,
+		"expired":       expired,
+	})
+	if expired {
+		entry.Warnf("Ignoring skip in user overrides as it expired on %s, scanning anyway", skip.Until)
+		return false, "", nil
+	}
+	entry.Warn("Skipping sonar scan due to developer UserOverrides")
+	if skip.Reason != "" {
+		return true, fmt.Sprintf("skipped by user overrides: %s", skip.Reason), nil
+	}
+	return true, "skipped by user overrides", nil
+}
+
+// clock returns the current time
+func (e *Patcher) clock() time.Time {
+	if e.now != nil {
+		return e.now()
+	}
+	return time.Now()
+}
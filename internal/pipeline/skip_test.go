@@ -0,0 +1,58 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	yaml "gopkg.in/yaml.v3"
+)
+
+func TestSkip_UnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    Skip
+		wantErr bool
+	}{
+		{"true", "skip: true", Skip{Enabled: true}, false},
+		{"false", "skip: false", Skip{}, false},
+		{"exemption", "skip: {reason: legacy code, ticket: GOV-12, owner: team-a, until: 2026-12-31}", Skip{Enabled: true, Reason: "legacy code", Ticket: "GOV-12", Owner: "team-a", Until: "2026-12-31"}, false},
+		{"not a boolean", "skip: maybe", Skip{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userOverrides := UserOverrides{}
+			err := yaml.Unmarshal([]byte(tt.content), &userOverrides)
+			assert.Equal(t, tt.wantErr, err != nil, "error %v", err)
+			assert.Equal(t, tt.want, userOverrides.Skip)
+		})
+	}
+}
+
+func TestPatcher_applySkip(t *testing.T) {
+	now := func() time.Time { return time.Date(2026, 10, 17, 15, 30, 0, 0, time.UTC) }
+	tests := []struct {
+		name       string
+		skip       Skip
+		wantSkip   bool
+		wantReason string
+		wantErr    bool
+	}{
+		{"not skipped", Skip{}, false, "", false},
+		{"skipped", Skip{Enabled: true}, true, "skipped by user overrides", false},
+		{"with reason", Skip{Enabled: true, Reason: "legacy code", Owner: "team-a"}, true, "skipped by user overrides: legacy code", false},
+		{"until today", Skip{Enabled: true, Until: "2026-10-17"}, true, "skipped by user overrides", false},
+		{"expired", Skip{Enabled: true, Reason: "legacy code", Until: "2026-10-16"}, false, "", false},
+		{"invalid until", Skip{Enabled: true, Until: "17/10/2026"}, false, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &Patcher{now: now}
+			skip, reason, err := e.applySkip(tt.skip)
+			assert.Equal(t, tt.wantErr, err != nil, "error %v", err)
+			assert.Equal(t, tt.wantSkip, skip)
+			assert.Equal(t, tt.wantReason, reason)
+		})
+	}
+}
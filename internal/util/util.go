@@ -3,10 +3,14 @@ package util
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/cenkalti/backoff"
+	"github.com/jenkins-x-apps/jx-app-sonar-scanner/internal/logging"
+	"github.com/pkg/errors"
 )
 
 var timeout = 60 * time.Second
@@ -81,6 +85,78 @@ func MoveFile(src string, dst string) (err error) {
 	return os.Rename(src, dst)
 }
 
+// WriteFileAtomic replaces the contents of the file named by path without ever leaving it
+// partially written. The content is written to a temporary file in the same directory, synced
+// to stable storage, checked with validate if one is given and only then renamed over path.
+// The directory is synced after the rename so that the rename itself survives a crash, a failure
+// to sync it is logged but not returned as path has been replaced by then. On any other failure
+// the temporary file is removed and path is left untouched.
+func WriteFileAtomic(path string, content []byte, validate func(path string) error) (err error) {
+	mode := os.FileMode(0644)
+	if si, statErr := os.Stat(path); statErr == nil {
+		mode = si.Mode()
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return errors.Wrapf(err, "unable to create temporary file for '%s'", path)
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "unable to write temporary file '%s'", tmp.Name())
+	}
+
+	err = os.Chmod(tmp.Name(), mode)
+	if err != nil {
+		return errors.Wrapf(err, "unable to set mode of temporary file '%s'", tmp.Name())
+	}
+
+	if validate != nil {
+		err = validate(tmp.Name())
+		if err != nil {
+			return errors.Wrapf(err, "invalid content for '%s'", path)
+		}
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return errors.Wrapf(err, "unable to replace '%s'", path)
+	}
+
+	// The rename is only durable once the directory holding it is synced too. The file has been replaced
+	// by then, so a failure is only worth a warning.
+	if syncErr := syncDir(filepath.Dir(path)); syncErr != nil {
+		logging.AppLogger().Warnf("'%s' was replaced but its directory could not be synced, the change may not survive a crash: %s", path, syncErr)
+	}
+	return nil
+}
+
+// syncDir flushes the entries of the directory named by dir to stable storage. It is a variable so that
+// tests can make it fail.
+var syncDir = func(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
 // FileExists checks if a file exists and is not a directory before we
 // try using it to prevent further errors.
 func FileExists(filename string) bool {
@@ -102,14 +178,17 @@ func AppropriateToScan() bool {
 func appropriateToScan(infrastructure bool, pipelineKind string) bool {
 	// Should we be attempting to patch in this execution scope?
 	if pipelineKind == "pullrequest" && !infrastructure {
-		fmt.Println("Detected preview build. Preparing to scan...")
+		fmt.Fprintln(logging.Output(), "Detected preview build. Preparing to scan...")
 		return true
 	} else if pipelineKind == "release" && !infrastructure {
-		fmt.Println("Detected release build. Preparing to scan...")
+		fmt.Fprintln(logging.Output(), "Detected release build. Preparing to scan...")
+		return true
+	} else if pipelineKind == "feature" && !infrastructure {
+		fmt.Fprintln(logging.Output(), "Detected feature build. Preparing to scan...")
 		return true
 	} else {
 		// Environment build so skip
-		fmt.Println("Skipping sonar-scan")
+		fmt.Fprintln(logging.Output(), "Skipping sonar-scan")
 		return false
 	}
 }
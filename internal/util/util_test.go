@@ -1,6 +1,7 @@
 package util
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -8,6 +9,8 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 	"github.com/udhos/equalfile"
 )
@@ -80,6 +83,8 @@ func Test_appropriateToScan(t *testing.T) {
 	}{
 		{"pullrequest", args{false, "pullrequest"}, true},
 		{"release", args{false, "release"}, true},
+		{"feature", args{false, "feature"}, true},
+		{"feature infrastructure", args{true, "feature"}, false},
 		{"infrastructure", args{true, "release"}, false},
 	}
 	for _, tt := range tests {
@@ -91,6 +96,15 @@ func Test_appropriateToScan(t *testing.T) {
 	}
 }
 
+func Test_appropriateToScan_output(t *testing.T) {
+	stderr := &bytes.Buffer{}
+	log.SetOutput(stderr)
+	defer log.SetOutput(os.Stdout)
+
+	appropriateToScan(false, "pullrequest")
+	assert.Equal(t, "Detected preview build. Preparing to scan...\n", stderr.String())
+}
+
 func TestCopyFile(t *testing.T) {
 	testDataLocation := "../../test/"
 	testRunName := "run-copyfile"
@@ -170,7 +184,90 @@ func TestCopyFileMissingDest(t *testing.T) {
 	assert.True(t, err != nil)
 }
 
+func TestWriteFileAtomic(t *testing.T) {
+	testDataLocation := "../../test/"
+	testRunName := "run-writeatomic"
+
+	tests := []struct {
+		name     string
+		validate func(path string) error
+		wantErr  bool
+		want     string
+	}{
+		{"no validation", nil, false, "replaced"},
+		{"valid", func(path string) error { return nil }, false, "replaced"},
+		{"invalid", func(path string) error { return errors.New("not valid") }, true, "original"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir(testDataLocation, testRunName)
+			assert.NoError(t, err)
+			defer func() {
+				err := os.RemoveAll(dir)
+				assert.NoError(t, err)
+			}()
+			path := filepath.Join(dir, "file")
+			err = ioutil.WriteFile(path, []byte("original"), 0640)
+			assert.NoError(t, err)
+
+			err = WriteFileAtomic(path, []byte("replaced"), tt.validate)
+			assert.Equal(t, tt.wantErr, err != nil, "error = %v", err)
+
+			content, err := ioutil.ReadFile(path)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, string(content))
+			info, err := os.Stat(path)
+			assert.NoError(t, err)
+			assert.Equal(t, os.FileMode(0640), info.Mode())
+
+			files, err := ioutil.ReadDir(dir)
+			assert.NoError(t, err)
+			assert.Len(t, files, 1, "temporary file left behind")
+		})
+	}
+}
+
+func Test_syncDir(t *testing.T) {
+	assert.NoError(t, syncDir("../../test/files"))
+	assert.Error(t, syncDir("../../test/files/missing"))
+}
+
+func TestWriteFileAtomicMissingDir(t *testing.T) {
+	err := WriteFileAtomic(filepath.Join("../../test/files", "missing", "file"), []byte("content"), nil)
+	assert.Error(t, err)
+}
+
 func TestFileExists(t *testing.T) {
 	assert.True(t, FileExists("../../test/files/original"))
 	assert.False(t, FileExists("../../test/files/pinkelephant"))
 }
+
+func TestWriteFileAtomic_syncDirFailure(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	sync := syncDir
+	syncDir = func(dir string) error { return errors.New("sync failed") }
+	defer func() { syncDir = sync }()
+
+	dir, err := ioutil.TempDir("../../test/", "run-writeatomic")
+	assert.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(dir)
+		assert.NoError(t, err)
+	}()
+	path := filepath.Join(dir, "file")
+	err = ioutil.WriteFile(path, []byte("original"), 0640)
+	assert.NoError(t, err)
+
+	// The file has been replaced by the time the directory is synced, so this is not an error
+	err = WriteFileAtomic(path, []byte("replaced"), nil)
+	assert.NoError(t, err)
+
+	content, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "replaced", string(content))
+	if assert.NotNil(t, hook.LastEntry()) {
+		assert.Equal(t, log.WarnLevel, hook.LastEntry().Level)
+		assert.Contains(t, hook.LastEntry().Message, "sync failed")
+	}
+}
@@ -20,3 +20,8 @@ func GetVersion() string {
 func GetFQImage() string {
 	return fmt.Sprintf("%s:%s", imageName, GetVersion())
 }
+
+// GetImageName returns the image name without a tag, which identifies steps running the scanner whatever their version.
+func GetImageName() string {
+	return imageName
+}
@@ -0,0 +1,3 @@
+module example.com/detected
+
+go 1.12